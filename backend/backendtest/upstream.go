@@ -0,0 +1,266 @@
+// Package backendtest runs an SFTP server in process, standing in for the
+// remote a Provider connects to.
+package backendtest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// NewKey generates a private key, and returns it along with its PEM
+// encoding.
+func NewKey() (ssh.Signer, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// Upstream is an SFTP server on a loopback port that serves the local
+// filesystem.
+type Upstream struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+
+	lock     sync.Mutex
+	conns    map[*ssh.ServerConn]bool
+	maxConns int
+	accepted int
+	requests int
+	ignoring bool
+	// paused is closed while requests are served, and replaced by an open
+	// channel while they're held up.
+	paused chan struct{}
+}
+
+// StartUpstream starts an Upstream that only accepts clients authenticating
+// with clientKey.
+func StartUpstream(clientKey ssh.PublicKey) (*Upstream, error) {
+	hostKey, _, err := NewKey()
+	if err != nil {
+		return nil, err
+	}
+	sshConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	sshConfig.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	u := &Upstream{
+		listener: listener,
+		hostKey:  hostKey,
+		conns:    map[*ssh.ServerConn]bool{},
+		paused:   make(chan struct{}),
+	}
+	close(u.paused)
+	go func() {
+		for {
+			nConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go u.serve(nConn, sshConfig)
+		}
+	}()
+	return u, nil
+}
+
+func (u *Upstream) serve(nConn net.Conn, sshConfig *ssh.ServerConfig) {
+	sConn, chans, reqs, err := ssh.NewServerConn(nConn, sshConfig)
+	if err != nil {
+		return
+	}
+	u.track(sConn)
+	defer u.untrack(sConn)
+
+	go u.answerRequests(reqs)
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				_ = req.Reply(req.Type == "subsystem", nil)
+			}
+		}(requests)
+		go func() {
+			server, err := sftp.NewServer(&pausable{channel, u})
+			if err != nil {
+				return
+			}
+			_ = server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+// answerRequests turns down global requests, such as keepalives, unless
+// they're being ignored.
+func (u *Upstream) answerRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		u.lock.Lock()
+		u.requests++
+		ignoring := u.ignoring
+		u.lock.Unlock()
+		if req.WantReply && !ignoring {
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+func (u *Upstream) track(c *ssh.ServerConn) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.conns[c] = true
+	u.accepted++
+	if len(u.conns) > u.maxConns {
+		u.maxConns = len(u.conns)
+	}
+}
+
+func (u *Upstream) untrack(c *ssh.ServerConn) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.conns, c)
+}
+
+// Addr returns the address the Upstream listens on.
+func (u *Upstream) Addr() string {
+	return u.listener.Addr().String()
+}
+
+// KnownHostsLine returns the line of a known_hosts file that trusts the
+// Upstream.
+func (u *Upstream) KnownHostsLine() string {
+	return knownhosts.Line([]string{u.Addr()}, u.hostKey.PublicKey())
+}
+
+// HostKeyCallback returns a callback that only trusts the Upstream.
+func (u *Upstream) HostKeyCallback() ssh.HostKeyCallback {
+	return ssh.FixedHostKey(u.hostKey.PublicKey())
+}
+
+// Conns returns the number of connections currently open.
+func (u *Upstream) Conns() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return len(u.conns)
+}
+
+// MaxConns returns the largest number of connections that were open at
+// once.
+func (u *Upstream) MaxConns() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.maxConns
+}
+
+// Accepted returns the number of connections accepted so far.
+func (u *Upstream) Accepted() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.accepted
+}
+
+// Requests returns the number of global requests, such as keepalives,
+// received so far.
+func (u *Upstream) Requests() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.requests
+}
+
+// IgnoreRequests stops answering global requests, as if the connections
+// were half-open and nothing sent to the remote got through.
+func (u *Upstream) IgnoreRequests() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.ignoring = true
+}
+
+// DropConns closes all open connections, as if the network failed.
+func (u *Upstream) DropConns() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for c := range u.conns {
+		_ = c.Close()
+	}
+}
+
+// Pause holds up requests until Resume is called.
+func (u *Upstream) Pause() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	select {
+	case <-u.paused:
+		u.paused = make(chan struct{})
+	default:
+	}
+}
+
+// Resume serves the requests held up by Pause.
+func (u *Upstream) Resume() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	select {
+	case <-u.paused:
+	default:
+		close(u.paused)
+	}
+}
+
+func (u *Upstream) resumed() <-chan struct{} {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.paused
+}
+
+// Close stops accepting connections and closes the open ones.
+func (u *Upstream) Close() {
+	_ = u.listener.Close()
+	u.Resume()
+	u.DropConns()
+}
+
+// pausable holds up reading the requests of an SFTP session while its
+// Upstream is paused.
+type pausable struct {
+	io.ReadWriteCloser
+	u *Upstream
+}
+
+func (p *pausable) Read(b []byte) (int, error) {
+	n, err := p.ReadWriteCloser.Read(b)
+	<-p.u.resumed()
+	return n, err
+}
@@ -0,0 +1,9 @@
+package backend
+
+import "time"
+
+func (r RetryPolicy) Backoff(retry int) time.Duration {
+	return r.backoff(retry)
+}
+
+var Transient = transient
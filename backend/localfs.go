@@ -0,0 +1,82 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+)
+
+// LocalFS provides access to the files in a local directory, such as a
+// mounted network share, in the same way Provider does for a remote.
+type LocalFS struct {
+	root string
+}
+
+// NewLocalFS creates a LocalFS that resolves paths relative to the directory
+// root. A root of "/" gives access to the whole filesystem.
+func NewLocalFS(root string) *LocalFS {
+	return &LocalFS{root: root}
+}
+
+// localPath returns the local path of the file at p. Paths can't lead
+// outside of the root.
+func (l *LocalFS) localPath(p string) string {
+	return filepath.Join(l.root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+// ReadFile reads the whole file at path.
+func (l *LocalFS) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(l.localPath(path))
+}
+
+// Open opens the file at path for reading.
+func (l *LocalFS) Open(path string) (filetree.File, error) {
+	file, err := os.Open(l.localPath(path))
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Stat returns the file info of the file or directory at path.
+func (l *LocalFS) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(l.localPath(path))
+}
+
+// ReadDir lists the directory at path.
+func (l *LocalFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(l.localPath(path))
+}
+
+// WriteFile writes data to the file at path. The file is created if it
+// doesn't exist, and truncated if it does.
+func (l *LocalFS) WriteFile(path string, data []byte) (int64, error) {
+	file, err := os.OpenFile(l.localPath(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := file.Write(data)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return int64(n), err
+}
+
+// Mkdir creates the directory at path.
+func (l *LocalFS) Mkdir(path string) error {
+	return os.Mkdir(l.localPath(path), 0755)
+}
+
+// Rename renames path to target, replacing target if it exists.
+func (l *LocalFS) Rename(path string, target string) error {
+	return os.Rename(l.localPath(path), l.localPath(target))
+}
+
+// Remove removes the file or empty directory at path.
+func (l *LocalFS) Remove(path string) error {
+	return os.Remove(l.localPath(path))
+}
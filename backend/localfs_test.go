@@ -0,0 +1,80 @@
+package backend_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/flawedmatrix/gocryptsftp/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LocalFS", func() {
+	var (
+		root    string
+		localFS *backend.LocalFS
+	)
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "localfs-test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Mkdir(filepath.Join(root, "dir"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(root, "dir", "file"), []byte("some data"), 0644)).To(Succeed())
+
+		localFS = backend.NewLocalFS(root)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	It("reads the files under the root", func() {
+		Expect(localFS.ReadFile("/dir/file")).To(Equal([]byte("some data")))
+
+		file, err := localFS.Open("/dir/file")
+		Expect(err).NotTo(HaveOccurred())
+		b := make([]byte, 4)
+		Expect(file.ReadAt(b, 5)).To(Equal(4))
+		Expect(string(b)).To(Equal("data"))
+		n, err := file.ReadAt(b, 7)
+		Expect(n).To(Equal(2))
+		Expect(err).To(Equal(io.EOF))
+		Expect(file.Close()).To(Succeed())
+
+		info, err := localFS.Stat("/dir/file")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size()).To(BeEquivalentTo(9))
+
+		infos, err := localFS.ReadDir("/dir")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infos).To(HaveLen(1))
+		Expect(infos[0].Name()).To(Equal("file"))
+	})
+
+	It("makes changes under the root", func() {
+		Expect(localFS.WriteFile("/dir/file", []byte("new"))).To(BeEquivalentTo(3))
+		Expect(localFS.Mkdir("/other")).To(Succeed())
+		Expect(localFS.Rename("/dir/file", "/other/file")).To(Succeed())
+		Expect(localFS.Remove("/dir")).To(Succeed())
+
+		Expect(ioutil.ReadFile(filepath.Join(root, "other", "file"))).To(Equal([]byte("new")))
+		_, err := os.Stat(filepath.Join(root, "dir"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("reports missing files as not existing", func() {
+		_, err := localFS.Stat("/missing")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		_, err = localFS.ReadFile("/dir/missing")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("doesn't let paths lead outside of the root", func() {
+		outside := filepath.Base(root) + "-outside"
+		Expect(localFS.WriteFile("/../"+outside, []byte("data"))).To(BeEquivalentTo(4))
+		Expect(ioutil.ReadFile(filepath.Join(root, outside))).To(Equal([]byte("data")))
+	})
+})
@@ -3,6 +3,9 @@ package backend
 import (
 	"errors"
 	"fmt"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
@@ -16,12 +19,12 @@ type conn struct {
 func newConn(remoteAddr string, clientConfig *ssh.ClientConfig) (*conn, error) {
 	sshClient, err := ssh.Dial("tcp", remoteAddr, clientConfig)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to remote server %s", err)
+		return nil, fmt.Errorf("failed to connect to remote server %w", err)
 	}
 	sftpClient, err := sftp.NewClient(sshClient)
 	if err != nil {
 		sshClient.Close()
-		return nil, fmt.Errorf("could not open sftp session to remote %s", err)
+		return nil, fmt.Errorf("could not open sftp session to remote %w", err)
 	}
 	c := &conn{
 		sshConn:  sshClient,
@@ -40,41 +43,425 @@ func (c *conn) Close() {
 	}
 }
 
+// alive tests the underlying ssh connection. The remote doesn't need to
+// understand the request, it only needs to answer it within timeout. A
+// connection that doesn't is considered dead, since it would otherwise hang
+// until TCP gives up on it.
+func (c *conn) alive(timeout time.Duration) bool {
+	answered := make(chan error, 1)
+	go func() {
+		_, _, err := c.sshConn.SendRequest("keepalive@openssh.com", true, nil)
+		answered <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-answered:
+		return err == nil
+	case <-timer.C:
+		return false
+	}
+}
+
+var errPoolClosed = errors.New("pool is closed")
+
+// ErrAcquireTimeout is returned for requests that waited longer than
+// PoolOptions.AcquireTimeout for a connection to the remote.
+var ErrAcquireTimeout = errors.New("timed out waiting for a connection to the remote")
+
+// PoolOptions holds the limits and timings of the pool of connections a
+// Provider keeps to the remote.
+type PoolOptions struct {
+	// Capacity is the number of idle connections kept open.
+	Capacity int
+	// MaxConns is the number of connections that can be open at once, idle
+	// or in use, including the ones kept by open files. Requests wait for a
+	// connection once they're all in use. Zero means no limit.
+	MaxConns int
+	// AcquireTimeout is how long a request waits for a connection before
+	// failing with ErrAcquireTimeout. Zero waits for as long as it takes.
+	AcquireTimeout time.Duration
+	// KeepaliveInterval is how often idle connections are checked. Dead ones
+	// are replaced right away. Zero turns off the checks.
+	KeepaliveInterval time.Duration
+	// KeepaliveTimeout is how long a connection is given to answer a check
+	// before it's considered dead. Zero uses DefaultKeepaliveTimeout.
+	KeepaliveTimeout time.Duration
+	// IdleTimeout is how long a connection is kept open while it isn't used.
+	// Zero keeps idle connections open.
+	IdleTimeout time.Duration
+}
+
+// DefaultPoolOptions returns the PoolOptions used when nothing else is
+// configured.
+func DefaultPoolOptions() PoolOptions {
+	return PoolOptions{
+		Capacity:          DefaultPoolCapacity,
+		MaxConns:          DefaultMaxConns,
+		AcquireTimeout:    30 * time.Second,
+		KeepaliveInterval: 30 * time.Second,
+		KeepaliveTimeout:  DefaultKeepaliveTimeout,
+		IdleTimeout:       5 * time.Minute,
+	}
+}
+
+// DefaultKeepaliveTimeout is the default time a connection is given to
+// answer a check.
+const DefaultKeepaliveTimeout = 10 * time.Second
+
+// PoolStats describes the state of the pool of connections of a Provider,
+// and counts what happened to them.
+type PoolStats struct {
+	// Open is the number of connections open or being opened, whether
+	// they're idle or in use.
+	Open int
+	// Idle is the number of open connections that aren't in use.
+	Idle int
+	// Waiting is the number of requests waiting for a connection.
+	Waiting int
+
+	// Dials counts the connections opened, and DialErrors the attempts that
+	// failed.
+	Dials      uint64
+	DialErrors uint64
+	// Timeouts counts the requests that gave up waiting for a connection.
+	Timeouts uint64
+	// Evicted counts the connections closed after being idle for
+	// IdleTimeout.
+	Evicted uint64
+	// Dead counts the connections that were closed because they stopped
+	// working.
+	Dead uint64
+	// Retries counts the requests made again after failing transiently.
+	Retries uint64
+}
+
+type idleConn struct {
+	c     *conn
+	since time.Time
+}
+
+// grant hands a connection over to a request waiting for one. A grant with a
+// nil connection lets the request open a new one instead.
+type grant struct {
+	c *conn
+}
+
 type pool struct {
-	conns chan *conn
+	opts   PoolOptions
+	logger *log.Logger
+
+	lock   sync.Mutex
+	closed bool
+	done   chan struct{}
+	// open counts the connections that are open or being opened.
+	open    int
+	idle    []idleConn
+	waiters []chan grant
+	stats   PoolStats
 
 	remoteAddr   string
 	clientConfig *ssh.ClientConfig
 }
 
-func newPool(capacity uint32, remoteAddr string, clientConfig *ssh.ClientConfig) *pool {
-	return &pool{
-		conns: make(chan *conn, capacity),
+func newPool(opts PoolOptions, remoteAddr string, clientConfig *ssh.ClientConfig, logger *log.Logger) *pool {
+	if opts.KeepaliveTimeout <= 0 {
+		opts.KeepaliveTimeout = DefaultKeepaliveTimeout
+	}
+	p := &pool{
+		opts:   opts,
+		logger: logger,
+		done:   make(chan struct{}),
 
 		remoteAddr:   remoteAddr,
 		clientConfig: clientConfig,
 	}
+	if interval := p.checkInterval(); interval > 0 {
+		go p.maintain(interval)
+	}
+	return p
 }
 
+// Get returns an idle connection, or opens a new one if there's none. Once
+// MaxConns connections are open, it waits for one to be put back.
 func (p *pool) Get() (*conn, error) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, errPoolClosed
+	}
+	if n := len(p.idle); n > 0 {
+		// The most recently used connection is taken, so that the others
+		// can become idle for long enough to be closed.
+		c := p.idle[n-1].c
+		p.idle = p.idle[:n-1]
+		p.lock.Unlock()
+		return c, nil
+	}
+	if p.opts.MaxConns <= 0 || p.open < p.opts.MaxConns {
+		p.open++
+		p.lock.Unlock()
+		return p.dial()
+	}
+	w := make(chan grant, 1)
+	p.waiters = append(p.waiters, w)
+	p.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if p.opts.AcquireTimeout > 0 {
+		timer := time.NewTimer(p.opts.AcquireTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
 	select {
-	case c := <-p.conns:
-		if c == nil {
-			return nil, errors.New("pool is closed")
+	case g := <-w:
+		return p.accept(g)
+	case <-timeout:
+		if !p.stopWaiting(w) {
+			// A connection was granted in the meantime.
+			return p.accept(<-w)
 		}
-		return c, nil
-	default:
-		return newConn(p.remoteAddr, p.clientConfig)
+		p.lock.Lock()
+		p.stats.Timeouts++
+		p.lock.Unlock()
+		return nil, ErrAcquireTimeout
+	case <-p.done:
+		if !p.stopWaiting(w) {
+			p.giveBack(<-w)
+		}
+		return nil, errPoolClosed
+	}
+}
+
+// accept returns the connection of g, or opens a new one in its place.
+func (p *pool) accept(g grant) (*conn, error) {
+	if g.c != nil {
+		return g.c, nil
+	}
+	return p.dial()
+}
+
+// giveBack returns what g granted to the pool unused.
+func (p *pool) giveBack(g grant) {
+	if g.c != nil {
+		p.Put(g.c)
+	} else {
+		p.release()
+	}
+}
+
+// stopWaiting removes w from the waiting requests. It returns false if it was
+// already granted a connection.
+func (p *pool) stopWaiting(w chan grant) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, waiter := range p.waiters {
+		if waiter == w {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// dial opens a new connection, which must already be counted as open.
+func (p *pool) dial() (*conn, error) {
+	c, err := newConn(p.remoteAddr, p.clientConfig)
+	p.lock.Lock()
+	p.stats.Dials++
+	if err != nil {
+		p.stats.DialErrors++
+	}
+	p.lock.Unlock()
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	return c, nil
+}
+
+// release stops counting a connection as open, and lets the longest waiting
+// request open one instead. The lock must not be held.
+func (p *pool) release() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.releaseLocked()
+}
+
+func (p *pool) releaseLocked() {
+	if len(p.waiters) > 0 && !p.closed {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		w <- grant{}
+		return
 	}
+	p.open--
 }
 
+// Put returns c to the pool once the request using it is done. It's handed
+// to the longest waiting request, or kept idle if there's room for it.
 func (p *pool) Put(c *conn) {
 	if c == nil {
 		return
 	}
-	select {
-	case p.conns <- c:
-	default:
+	p.putIdle(c, time.Now())
+}
+
+// putIdle returns c to the pool as having been idle since the given time.
+func (p *pool) putIdle(c *conn, since time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		p.open--
 		c.Close()
+		return
+	}
+	if len(p.waiters) > 0 {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		w <- grant{c: c}
+		return
+	}
+	if len(p.idle) < p.opts.Capacity {
+		p.idle = append(p.idle, idleConn{c: c, since: since})
+		return
+	}
+	p.open--
+	c.Close()
+}
+
+// Discard closes c, which stopped working, instead of returning it to the
+// pool. A new connection is opened in the background to replace it, so that
+// the next request doesn't have to wait for one.
+func (p *pool) Discard(c *conn) {
+	c.Close()
+	p.lock.Lock()
+	p.stats.Dead++
+	p.releaseLocked()
+	p.lock.Unlock()
+	go p.reconnect()
+}
+
+// reconnect opens a new idle connection if there's room for one.
+func (p *pool) reconnect() {
+	p.lock.Lock()
+	full := len(p.idle) >= p.opts.Capacity || (p.opts.MaxConns > 0 && p.open >= p.opts.MaxConns)
+	if p.closed || full || len(p.waiters) > 0 {
+		p.lock.Unlock()
+		return
+	}
+	p.open++
+	p.lock.Unlock()
+
+	c, err := p.dial()
+	if err != nil {
+		p.logger.Println("failed to reconnect to the remote:", err)
+		return
+	}
+	p.Put(c)
+}
+
+// checkInterval returns how often the idle connections need to be checked,
+// or zero if they don't.
+func (p *pool) checkInterval() time.Duration {
+	interval := p.opts.KeepaliveInterval
+	if p.opts.IdleTimeout > 0 && (interval <= 0 || p.opts.IdleTimeout < interval) {
+		interval = p.opts.IdleTimeout
+	}
+	return interval
+}
+
+// maintain checks the idle connections every interval until the pool is
+// closed.
+func (p *pool) maintain(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.check(time.Now())
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// check closes the connections that have been idle for longer than
+// IdleTimeout, and tests the ones that have been idle for at least
+// KeepaliveInterval. The connections being tested are taken out of the pool,
+// so that they aren't used in the meantime.
+func (p *pool) check(now time.Time) {
+	var expired, stale []idleConn
+	p.lock.Lock()
+	kept := p.idle[:0]
+	for _, ic := range p.idle {
+		idleFor := now.Sub(ic.since)
+		switch {
+		case p.opts.IdleTimeout > 0 && idleFor >= p.opts.IdleTimeout:
+			expired = append(expired, ic)
+		case p.opts.KeepaliveInterval > 0 && idleFor >= p.opts.KeepaliveInterval:
+			stale = append(stale, ic)
+		default:
+			kept = append(kept, ic)
+		}
+	}
+	p.idle = kept
+	p.stats.Evicted += uint64(len(expired))
+	p.lock.Unlock()
+
+	for _, ic := range expired {
+		ic.c.Close()
+		p.release()
+	}
+	// The stale connections are tested all at once, so that one that hangs
+	// doesn't hold up the others.
+	var wg sync.WaitGroup
+	for _, ic := range stale {
+		wg.Add(1)
+		go func(ic idleConn) {
+			defer wg.Done()
+			if p.alive(ic.c) {
+				p.putIdle(ic.c, ic.since)
+			} else {
+				p.logger.Println("closing dead connection to the remote")
+				p.Discard(ic.c)
+			}
+		}(ic)
+	}
+	wg.Wait()
+}
+
+// alive tests whether c still works, giving it up to KeepaliveTimeout to
+// answer.
+func (p *pool) alive(c *conn) bool {
+	return c.alive(p.opts.KeepaliveTimeout)
+}
+
+// Stats returns the current state of the pool.
+func (p *pool) Stats() PoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stats := p.stats
+	stats.Open = p.open
+	stats.Idle = len(p.idle)
+	stats.Waiting = len(p.waiters)
+	return stats
+}
+
+// Close closes the idle connections, and every connection that's put back
+// afterwards. Get fails once the pool is closed, including for the requests
+// waiting for a connection.
+func (p *pool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+	for _, ic := range p.idle {
+		ic.c.Close()
 	}
+	p.open -= len(p.idle)
+	p.idle = nil
 }
@@ -2,9 +2,15 @@ package backend
 
 import (
 	"bytes"
+	"io"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -14,85 +20,306 @@ import (
 // it's basically the same thing as calling ReadFile on a connection in serial.
 // What this package does provide is a guarantee that if you call ReadFile from
 // multiple goroutines, no two concurrent calls will share the same connection.
+//
+// Requests that only read from the remote are retried according to a
+// RetryPolicy when they fail transiently. Requests that change files aren't,
+// since they might have been carried out before failing.
 type Provider struct {
-	p *pool
+	// retries is first so that it's aligned for atomic access.
+	retries uint64
+	p       *pool
+	retry   RetryPolicy
 }
 
-// NewProvider creates a new instance of a Provider
-func NewProvider(remoteAddr string, clientConfig *ssh.ClientConfig, logger *log.Logger) *Provider {
+// DefaultPoolCapacity is the default number of idle connections kept open to
+// the remote.
+const DefaultPoolCapacity = 32
+
+// DefaultMaxConns is the default number of connections that can be open to
+// the remote at once.
+const DefaultMaxConns = 64
+
+// NewProvider creates a new instance of a Provider whose connections to the
+// remote are pooled according to opts, and whose reads are retried according
+// to retry.
+func NewProvider(remoteAddr string, opts PoolOptions, retry RetryPolicy, clientConfig *ssh.ClientConfig, logger *log.Logger) *Provider {
 	return &Provider{
-		p: newPool(32, remoteAddr, clientConfig),
+		p:     newPool(opts, remoteAddr, clientConfig, logger),
+		retry: retry,
+	}
+}
+
+// Close closes the connections to the remote. Requests made afterwards fail,
+// and connections in use are closed once their requests are done.
+func (p *Provider) Close() {
+	p.p.Close()
+}
+
+// Stats returns the state of the pool of connections to the remote.
+func (p *Provider) Stats() PoolStats {
+	stats := p.p.Stats()
+	stats.Retries = atomic.LoadUint64(&p.retries)
+	return stats
+}
+
+// release returns the connection to the pool. If the operation performed on
+// the connection failed for any other reason than an answer from the remote,
+// the underlying ssh connection is tested first, and the connection is
+// replaced instead if it's no longer usable. It returns whether the
+// connection was replaced.
+func (p *Provider) release(c *conn, opErr error) bool {
+	if opErr != nil && !answered(opErr) && !p.p.alive(c) {
+		p.p.Discard(c)
+		return true
+	}
+	p.p.Put(c)
+	return false
+}
+
+// retrying acquires a connection from the connection pool and calls op with
+// it. If op fails transiently, or its connection turns out to be dead, it's
+// called again on another connection after a backoff, up to the number of
+// attempts allowed by the retry policy.
+func (p *Provider) retrying(op func(c *conn) error) error {
+	c, err := p.acquiring(op)
+	if err == nil {
+		p.p.Put(c)
+	}
+	return err
+}
+
+// acquiring is like retrying, except that the connection op succeeded on is
+// returned instead of being put back into the pool.
+func (p *Provider) acquiring(op func(c *conn) error) (*conn, error) {
+	for attempt := 1; ; attempt++ {
+		dead := false
+		c, err := p.p.Get()
+		if err == nil {
+			if err = op(c); err == nil {
+				return c, nil
+			}
+			dead = p.release(c, err)
+		}
+		if !p.retryAfter(attempt, dead, err) {
+			return nil, err
+		}
 	}
 }
 
+// retryAfter tells whether a request that failed with err is tried again
+// after the given attempt, and waits for the backoff if it is.
+func (p *Provider) retryAfter(attempt int, dead bool, err error) bool {
+	if attempt >= p.retry.MaxAttempts || !(dead || transient(err)) {
+		return false
+	}
+	timer := time.NewTimer(p.retry.backoff(attempt - 1))
+	select {
+	case <-timer.C:
+	case <-p.p.done:
+		timer.Stop()
+		return false
+	}
+	atomic.AddUint64(&p.retries, 1)
+	return true
+}
+
 // ReadFile acquires a connection from the connection pool and calls ReadFile
 // on the acquired SFTP connection.
 func (p *Provider) ReadFile(path string) ([]byte, error) {
-	c, err := p.p.Get()
+	var data []byte
+	err := p.retrying(func(c *conn) error {
+		file, err := c.sftpConn.Open(path)
+		if err != nil {
+			return err
+		}
+		buf := new(bytes.Buffer)
+		_, err = file.WriteTo(buf)
+		_ = file.Close()
+		data = buf.Bytes()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	file, err := c.sftpConn.Open(path)
+	return data, nil
+}
+
+// Open acquires a connection from the connection pool and opens the file at
+// path on the acquired SFTP connection for reading. The connection is kept
+// for the file until it's closed, so open files count against MaxConns.
+func (p *Provider) Open(path string) (filetree.File, error) {
+	f := &remoteFile{p: p, path: path}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// remoteFile is a file opened on the remote through one of the connections
+// of a Provider. If a read fails because of the connection, the file is
+// opened again on another connection.
+type remoteFile struct {
+	p    *Provider
+	path string
+
+	lock sync.Mutex
+	c    *conn
+	file *sftp.File
+}
+
+// open opens the file on a connection acquired from the pool.
+func (f *remoteFile) open() error {
+	var file *sftp.File
+	c, err := f.p.acquiring(func(c *conn) (err error) {
+		file, err = c.sftpConn.Open(f.path)
+		return err
+	})
 	if err != nil {
-		// Test the underlying ssh connection to see if it's still okay.
-		_, _, sshErr := c.sshConn.SendRequest("ping", true, nil)
-		if sshErr != nil {
-			c.Close()
-		} else {
-			p.p.Put(c)
+		return err
+	}
+	f.c, f.file = c, file
+	return nil
+}
+
+// drop gives up on the file after a read failed with err. The file is
+// closed and its connection returned to the pool, unless the connection
+// turns out to be dead, in which case it's replaced. It returns whether the
+// connection was replaced.
+func (f *remoteFile) drop(err error) bool {
+	c, file := f.c, f.file
+	f.c, f.file = nil, nil
+	// Closing the file on a dead connection could hang, so the connection
+	// is tested first.
+	if !answered(err) && !f.p.p.alive(c) {
+		f.p.p.Discard(c)
+		return true
+	}
+	_ = file.Close()
+	f.p.p.Put(c)
+	return false
+}
+
+// ReadAt reads len(b) bytes starting at offset off, with the same semantics
+// as io.ReaderAt.
+func (f *remoteFile) ReadAt(b []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for attempt := 1; ; attempt++ {
+		if f.file == nil {
+			if err := f.open(); err != nil {
+				return 0, err
+			}
 		}
-		return nil, err
+		n, err := f.file.ReadAt(b, off)
+		// Reaching the end of the file says nothing about the connection,
+		// and isn't worth retrying.
+		if err == nil || err == io.EOF || answered(err) {
+			return n, err
+		}
+		dead := f.drop(err)
+		if !f.p.retryAfter(attempt, dead, err) {
+			return n, err
+		}
+	}
+}
+
+// Close closes the file and returns its connection to the pool.
+func (f *remoteFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return nil
 	}
-	defer p.p.Put(c)
-	defer func() { _ = file.Close() }()
-	buf := new(bytes.Buffer)
-	_, err = file.WriteTo(buf)
+	err := f.file.Close()
+	f.p.release(f.c, err)
+	f.c, f.file = nil, nil
+	return err
+}
+
+// WriteFile acquires a connection from the connection pool and writes data
+// to the file at path on the acquired SFTP connection. The file is created if
+// it doesn't exist, and truncated if it does.
+func (p *Provider) WriteFile(path string, data []byte) (int64, error) {
+	c, err := p.p.Get()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	return buf.Bytes(), nil
+	file, err := c.sftpConn.Create(path)
+	if err != nil {
+		p.release(c, err)
+		return 0, err
+	}
+	n, err := file.Write(data)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	p.release(c, err)
+	return int64(n), err
 }
 
-// ReadDir acquires a connection from the connection pool and calls ReadDir
+// Mkdir acquires a connection from the connection pool and calls Mkdir
 // on the acquired SFTP connection.
-func (p *Provider) ReadDir(path string) ([]os.FileInfo, error) {
+func (p *Provider) Mkdir(path string) error {
 	c, err := p.p.Get()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	listing, err := c.sftpConn.ReadDir(path)
+	err = c.sftpConn.Mkdir(path)
+	p.release(c, err)
+	return err
+}
+
+// Rename acquires a connection from the connection pool and renames path to
+// target on the acquired SFTP connection, replacing target if it exists.
+func (p *Provider) Rename(path string, target string) error {
+	c, err := p.p.Get()
+	if err != nil {
+		return err
+	}
+	err = c.sftpConn.PosixRename(path, target)
+	p.release(c, err)
+	return err
+}
+
+// Remove acquires a connection from the connection pool and removes the file
+// or empty directory at path on the acquired SFTP connection.
+func (p *Provider) Remove(path string) error {
+	c, err := p.p.Get()
+	if err != nil {
+		return err
+	}
+	err = c.sftpConn.Remove(path)
+	p.release(c, err)
+	return err
+}
+
+// ReadDir acquires a connection from the connection pool and calls ReadDir
+// on the acquired SFTP connection.
+func (p *Provider) ReadDir(path string) ([]os.FileInfo, error) {
+	var listing []os.FileInfo
+	err := p.retrying(func(c *conn) error {
+		var err error
+		listing, err = c.sftpConn.ReadDir(path)
+		return err
+	})
 	if err != nil {
-		// Test the underlying ssh connection to see if it's still okay.
-		_, _, sshErr := c.sshConn.SendRequest("ping", true, nil)
-		if sshErr != nil {
-			c.Close()
-		} else {
-			p.p.Put(c)
-		}
 		return nil, err
 	}
-	p.p.Put(c)
 	return listing, nil
 }
 
 // Stat acquires a connection from the connection pool and calls Stat
 // on the acquired SFTP connection.
 func (p *Provider) Stat(path string) (os.FileInfo, error) {
-	c, err := p.p.Get()
+	var stat os.FileInfo
+	err := p.retrying(func(c *conn) error {
+		var err error
+		stat, err = c.sftpConn.Stat(path)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	stat, err := c.sftpConn.Stat(path)
-	if err != nil {
-		// Test the underlying ssh connection to see if it's still okay.
-		_, _, sshErr := c.sshConn.SendRequest("ping", true, nil)
-		if sshErr != nil {
-			c.Close()
-		} else {
-			p.p.Put(c)
-		}
-		return nil, err
-	}
-	p.p.Put(c)
 	return stat, nil
 }
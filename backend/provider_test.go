@@ -0,0 +1,334 @@
+package backend_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/flawedmatrix/gocryptsftp/backend"
+	"github.com/flawedmatrix/gocryptsftp/backend/backendtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("Provider", func() {
+	var (
+		dir      string
+		filePath string
+		remote   *backendtest.Upstream
+		config   *ssh.ClientConfig
+		opts     backend.PoolOptions
+		retry    backend.RetryPolicy
+		provider *backend.Provider
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "provider-test")
+		Expect(err).NotTo(HaveOccurred())
+		filePath = filepath.Join(dir, "file")
+		Expect(ioutil.WriteFile(filePath, []byte("some data"), 0644)).To(Succeed())
+
+		clientKey, _, err := backendtest.NewKey()
+		Expect(err).NotTo(HaveOccurred())
+		remote, err = backendtest.StartUpstream(clientKey.PublicKey())
+		Expect(err).NotTo(HaveOccurred())
+		config = &ssh.ClientConfig{
+			User:            "remote-user",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+			HostKeyCallback: remote.HostKeyCallback(),
+		}
+
+		opts = backend.PoolOptions{Capacity: 4}
+		retry = backend.RetryPolicy{}
+	})
+
+	JustBeforeEach(func() {
+		provider = backend.NewProvider(remote.Addr(), opts, retry, config, log.New(GinkgoWriter, "", 0))
+	})
+
+	AfterEach(func() {
+		provider.Close()
+		remote.Close()
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	// statInBackground stats the file without waiting for the result.
+	statInBackground := func() <-chan error {
+		result := make(chan error, 1)
+		go func() {
+			_, err := provider.Stat(filePath)
+			result <- err
+		}()
+		return result
+	}
+
+	It("makes requests to the remote", func() {
+		Expect(provider.ReadFile(filePath)).To(Equal([]byte("some data")))
+		info, err := provider.Stat(filePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size()).To(BeEquivalentTo(9))
+	})
+
+	It("keeps a connection for each open file until it's closed", func() {
+		file, err := provider.Open(filePath)
+		Expect(err).NotTo(HaveOccurred())
+		buf := make([]byte, 4)
+		for i := 0; i < 3; i++ {
+			Expect(file.ReadAt(buf, 5)).To(Equal(4))
+			Expect(string(buf)).To(Equal("data"))
+		}
+		stats := provider.Stats()
+		Expect(stats.Open).To(Equal(1))
+		Expect(stats.Idle).To(BeZero())
+
+		Expect(file.Close()).To(Succeed())
+		Expect(provider.Stats().Idle).To(Equal(1))
+		Expect(remote.Accepted()).To(Equal(1))
+	})
+
+	It("reuses idle connections", func() {
+		for i := 0; i < 5; i++ {
+			_, err := provider.Stat(filePath)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(remote.Accepted()).To(Equal(1))
+		stats := provider.Stats()
+		Expect(stats.Open).To(Equal(1))
+		Expect(stats.Idle).To(Equal(1))
+		Expect(stats.Dials).To(BeEquivalentTo(1))
+	})
+
+	Context("when the number of connections is capped", func() {
+		BeforeEach(func() {
+			opts.MaxConns = 2
+		})
+
+		It("never opens more connections, however many requests are made", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					_, err := provider.Stat(filePath)
+					Expect(err).NotTo(HaveOccurred())
+				}()
+			}
+			wg.Wait()
+			Expect(remote.MaxConns()).To(BeNumerically("<=", 2))
+			Expect(provider.Stats().Dials).To(BeNumerically("<=", 2))
+		})
+
+		It("makes requests wait for a connection to be put back", func() {
+			remote.Pause()
+			var results []<-chan error
+			for i := 0; i < 3; i++ {
+				results = append(results, statInBackground())
+			}
+			Eventually(func() int { return provider.Stats().Waiting }).Should(Equal(1))
+			Expect(provider.Stats().Open).To(Equal(2))
+
+			remote.Resume()
+			for _, result := range results {
+				Eventually(result).Should(Receive(BeNil()))
+			}
+			Expect(remote.Accepted()).To(Equal(2))
+		})
+
+		Context("with an acquire timeout", func() {
+			BeforeEach(func() {
+				opts.AcquireTimeout = 50 * time.Millisecond
+			})
+
+			It("fails requests that wait for longer", func() {
+				remote.Pause()
+				first, second := statInBackground(), statInBackground()
+				Eventually(func() int { return provider.Stats().Open }).Should(Equal(2))
+
+				_, err := provider.Stat(filePath)
+				Expect(err).To(Equal(backend.ErrAcquireTimeout))
+				Expect(provider.Stats().Timeouts).To(BeEquivalentTo(1))
+
+				remote.Resume()
+				Eventually(first).Should(Receive(BeNil()))
+				Eventually(second).Should(Receive(BeNil()))
+			})
+		})
+
+		It("fails the waiting requests when closed", func() {
+			remote.Pause()
+			statInBackground()
+			statInBackground()
+			Eventually(func() int { return provider.Stats().Open }).Should(Equal(2))
+			waiting := statInBackground()
+			Eventually(func() int { return provider.Stats().Waiting }).Should(Equal(1))
+
+			provider.Close()
+			Eventually(waiting).Should(Receive(HaveOccurred()))
+			remote.Resume()
+		})
+	})
+
+	Context("with an idle timeout", func() {
+		BeforeEach(func() {
+			opts.IdleTimeout = 50 * time.Millisecond
+		})
+
+		It("closes connections that aren't used for longer", func() {
+			_, err := provider.Stat(filePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(remote.Conns()).To(Equal(1))
+
+			Eventually(remote.Conns).Should(Equal(0))
+			stats := provider.Stats()
+			Expect(stats.Evicted).To(BeEquivalentTo(1))
+			Expect(stats.Open).To(Equal(0))
+
+			_, err = provider.Stat(filePath)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("with keepalives", func() {
+		BeforeEach(func() {
+			opts.KeepaliveInterval = 20 * time.Millisecond
+			opts.KeepaliveTimeout = 50 * time.Millisecond
+		})
+
+		It("replaces idle connections that died", func() {
+			_, err := provider.Stat(filePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			remote.DropConns()
+			Eventually(func() uint64 { return provider.Stats().Dead }).Should(BeEquivalentTo(1))
+			Eventually(remote.Accepted).Should(Equal(2))
+			Eventually(func() int { return provider.Stats().Idle }).Should(Equal(1))
+
+			_, err = provider.Stat(filePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(remote.Accepted()).To(Equal(2))
+		})
+
+		It("replaces idle connections that don't answer in time", func() {
+			_, err := provider.Stat(filePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			remote.IgnoreRequests()
+			Eventually(func() uint64 { return provider.Stats().Dead }).Should(BeNumerically(">=", 1))
+			Eventually(remote.Accepted).Should(BeNumerically(">=", 2))
+		})
+
+		It("keeps idle connections that are alive", func() {
+			_, err := provider.Stat(filePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			// Idle connections are taken out of the pool while they're
+			// checked, so only the open ones are counted.
+			Consistently(func() int { return provider.Stats().Open }, 100*time.Millisecond).Should(Equal(1))
+			Expect(provider.Stats().Dead).To(BeZero())
+			Expect(remote.Accepted()).To(Equal(1))
+		})
+	})
+
+	It("doesn't test the connection after answers from the remote", func() {
+		_, err := provider.Stat(filepath.Join(dir, "missing"))
+		Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		Expect(remote.Requests()).To(BeZero())
+		Expect(provider.Stats().Idle).To(Equal(1))
+	})
+
+	It("replaces a connection that died during a request", func() {
+		_, err := provider.Stat(filePath)
+		Expect(err).NotTo(HaveOccurred())
+
+		remote.DropConns()
+		Eventually(remote.Conns).Should(Equal(0))
+		_, err = provider.Stat(filePath)
+		Expect(err).To(HaveOccurred())
+		Expect(provider.Stats().Dead).To(BeEquivalentTo(1))
+
+		Eventually(remote.Accepted).Should(Equal(2))
+		_, err = provider.Stat(filePath)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Context("with retries", func() {
+		BeforeEach(func() {
+			retry = backend.RetryPolicy{
+				MaxAttempts:    3,
+				InitialBackoff: 10 * time.Millisecond,
+				MaxBackoff:     20 * time.Millisecond,
+			}
+		})
+
+		It("retries reads whose connection died", func() {
+			_, err := provider.Stat(filePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			remote.DropConns()
+			Eventually(remote.Conns).Should(Equal(0))
+			Expect(provider.ReadFile(filePath)).To(Equal([]byte("some data")))
+			stats := provider.Stats()
+			Expect(stats.Dead).To(BeEquivalentTo(1))
+			Expect(stats.Retries).To(BeEquivalentTo(1))
+		})
+
+		It("doesn't retry reads of files that don't exist", func() {
+			_, err := provider.Stat(filepath.Join(dir, "missing"))
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+			_, err = provider.ReadDir(filepath.Join(dir, "missing"))
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+			Expect(provider.Stats().Retries).To(BeZero())
+		})
+
+		It("doesn't retry reads past the end of a file", func() {
+			file, err := provider.Open(filePath)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+			buf := make([]byte, 20)
+			n, err := file.ReadAt(buf, 5)
+			Expect(err).To(Equal(io.EOF))
+			Expect(string(buf[:n])).To(Equal("data"))
+			Expect(provider.Stats().Retries).To(BeZero())
+		})
+
+		It("opens files again when their connection died", func() {
+			file, err := provider.Open(filePath)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			remote.DropConns()
+			Eventually(remote.Conns).Should(Equal(0))
+			buf := make([]byte, 4)
+			Expect(file.ReadAt(buf, 5)).To(Equal(4))
+			Expect(string(buf)).To(Equal("data"))
+			stats := provider.Stats()
+			Expect(stats.Dead).To(BeEquivalentTo(1))
+			Expect(stats.Retries).To(BeEquivalentTo(1))
+		})
+
+		It("gives up once every attempt failed", func() {
+			remote.Close()
+			_, err := provider.Stat(filePath)
+			Expect(err).To(HaveOccurred())
+			stats := provider.Stats()
+			Expect(stats.DialErrors).To(BeEquivalentTo(3))
+			Expect(stats.Retries).To(BeEquivalentTo(2))
+		})
+
+		It("doesn't retry writes", func() {
+			_, err := provider.WriteFile(filepath.Join(dir, "missing", "file"), []byte("data"))
+			Expect(err).To(HaveOccurred())
+			remote.Close()
+			Expect(provider.Mkdir(filepath.Join(dir, "dir"))).NotTo(Succeed())
+			Expect(provider.Stats().Retries).To(BeZero())
+		})
+	})
+})
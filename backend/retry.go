@@ -0,0 +1,103 @@
+package backend
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// RetryPolicy says how requests to the remote that fail transiently, such as
+// when the connection they were made on is reset, are retried. Requests that
+// fail with an answer from the remote, such as a file not existing or
+// permission being denied, are never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is made before its error
+	// is returned. Zero or one makes requests only once.
+	MaxAttempts int
+	// InitialBackoff is the longest wait before the first retry. The wait
+	// doubles with every retry after that, and is picked at random between
+	// half of it and all of it, so that the requests that failed together
+	// don't all retry at the same time.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between two retries.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy returns the RetryPolicy used when nothing else is
+// configured.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+	}
+}
+
+// backoff returns how long to wait before the given retry, counting from
+// zero.
+func (r RetryPolicy) backoff(retry int) time.Duration {
+	d := r.InitialBackoff
+	for i := 0; i < retry && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+	if r.MaxBackoff > 0 && d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// answered tells whether err is the remote's answer to a request, such as a
+// file not existing, rather than a failure to get one.
+func answered(err error) bool {
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, os.ErrPermission), errors.Is(err, os.ErrExist):
+		return true
+	}
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.Code {
+		case uint32(sftp.ErrSSHFxConnectionLost), uint32(sftp.ErrSSHFxNoConnection):
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// transient tells whether err may go away if the request is made again,
+// because it came from the connection to the remote rather than from the
+// remote itself.
+func transient(err error) bool {
+	switch {
+	case err == nil, answered(err):
+		return false
+	case errors.Is(err, ErrAcquireTimeout), errors.Is(err, errPoolClosed):
+		// Retrying would only make the request wait longer than it's
+		// allowed to.
+		return false
+	case errors.Is(err, sftp.ErrSSHFxConnectionLost), errors.Is(err, sftp.ErrSSHFxNoConnection):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EPIPE):
+		return true
+	}
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) {
+		// Only connection failures aren't answers.
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,79 @@
+package backend_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/flawedmatrix/gocryptsftp/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/sftp"
+)
+
+var _ = Describe("RetryPolicy", func() {
+	policy := backend.RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     300 * time.Millisecond,
+	}
+
+	It("doubles the backoff with every retry, up to the maximum", func() {
+		for retry, max := range []time.Duration{
+			100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond,
+		} {
+			for i := 0; i < 20; i++ {
+				backoff := policy.Backoff(retry)
+				Expect(backoff).To(BeNumerically(">=", max/2), fmt.Sprint(retry))
+				Expect(backoff).To(BeNumerically("<=", max), fmt.Sprint(retry))
+			}
+		}
+	})
+
+	It("adds jitter to the backoff", func() {
+		backoffs := map[time.Duration]bool{}
+		for i := 0; i < 20; i++ {
+			backoffs[policy.Backoff(0)] = true
+		}
+		Expect(len(backoffs)).To(BeNumerically(">", 1))
+	})
+
+	It("doesn't back off when there's no initial backoff", func() {
+		Expect(backend.RetryPolicy{MaxAttempts: 3}.Backoff(2)).To(BeZero())
+	})
+})
+
+var _ = Describe("Transient", func() {
+	It("retries errors from the connection to the remote", func() {
+		for _, err := range []error{
+			sftp.ErrSSHFxConnectionLost,
+			&sftp.StatusError{Code: uint32(sftp.ErrSSHFxNoConnection)},
+			io.EOF,
+			io.ErrUnexpectedEOF,
+			&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET},
+			fmt.Errorf("failed to connect to remote server %w", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}),
+		} {
+			Expect(backend.Transient(err)).To(BeTrue(), err.Error())
+		}
+	})
+
+	It("doesn't retry answers from the remote", func() {
+		for _, err := range []error{
+			nil,
+			os.ErrNotExist,
+			os.ErrPermission,
+			&os.PathError{Op: "open", Path: "/file", Err: os.ErrNotExist},
+			&sftp.StatusError{Code: uint32(sftp.ErrSSHFxNoSuchFile)},
+			&sftp.StatusError{Code: uint32(sftp.ErrSSHFxPermissionDenied)},
+			&sftp.StatusError{Code: uint32(sftp.ErrSSHFxFailure)},
+			backend.ErrAcquireTimeout,
+			errors.New("ssh: handshake failed: unable to authenticate"),
+		} {
+			Expect(backend.Transient(err)).To(BeFalse(), fmt.Sprint(err))
+		}
+	})
+})
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+
+	"github.com/flawedmatrix/gocryptsftp/backend"
+	"github.com/flawedmatrix/gocryptsftp/config"
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/configfile"
+	"github.com/flawedmatrix/gocryptsftp/server"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// checkConfig validates cfg and checks that everything it refers to can be
+// used, without starting the server. The result of each check is written to
+// out. It returns false if any of the checks failed.
+func checkConfig(cfg *config.Config, out io.Writer) bool {
+	ok := true
+	report := func(check string, err error) {
+		if err != nil {
+			ok = false
+			fmt.Fprintf(out, "FAIL %s: %s\n", check, err)
+			return
+		}
+		fmt.Fprintf(out, "ok   %s\n", check)
+	}
+	validErr := cfg.Validate()
+	report("config", validErr)
+
+	hostKeyCallback, err := knownhosts.New(cfg.KnownHostsPath)
+	report(fmt.Sprintf("known hosts %s", cfg.KnownHostsPath), err)
+
+	for _, v := range cfg.AllVolumes() {
+		confPath := path.Join(v.Remote.FileRoot, configfile.ConfDefaultName)
+		if v.Remote.Local {
+			_, err := backend.NewLocalFS("/").Stat(confPath)
+			report(fmt.Sprintf("%s on the local filesystem", confPath), err)
+			continue
+		}
+
+		keysCheck := "remote keys"
+		if v.Name != "" {
+			keysCheck = fmt.Sprintf("remote keys of volume %s", v.Name)
+		}
+		remoteAuth, err := v.RemoteAuth()
+		report(keysCheck, err)
+
+		remoteCheck := fmt.Sprintf("%s on %s", confPath, v.Remote.Addr)
+		if validErr != nil || remoteAuth == nil || hostKeyCallback == nil {
+			fmt.Fprintf(out, "skip %s: fix the problems above first\n", remoteCheck)
+			ok = false
+			continue
+		}
+		clientConfig := server.RemoteClientConfig(v.Remote, remoteAuth, hostKeyCallback)
+		// The remote is only tried once, so that it's reported as it is.
+		provider := backend.NewProvider(v.Remote.Addr, backend.PoolOptions{Capacity: 1}, backend.RetryPolicy{}, clientConfig, log.New(ioutil.Discard, "", 0))
+		_, err = provider.Stat(confPath)
+		provider.Close()
+		report(remoteCheck, err)
+	}
+	return ok
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentSockEnv is the environment variable holding the path of the
+// ssh-agent socket.
+const agentSockEnv = "SSH_AUTH_SOCK"
+
+// RemoteAuth returns the auth method for connecting to the remote of the
+// volume served at the root.
+func (c *Config) RemoteAuth() (ssh.AuthMethod, error) {
+	return c.rootVolume().RemoteAuth()
+}
+
+// RemoteAuth returns the auth method for connecting to the remote. It offers
+// the keys in the ssh-agent at SSH_AUTH_SOCK if Remote.UseAgent is set,
+// followed by the key at Remote.PrivateKeyPath if that's set.
+func (v *VolumeConfig) RemoteAuth() (ssh.AuthMethod, error) {
+	var fileSigners []ssh.Signer
+	if v.Remote.PrivateKeyPath != "" {
+		signer, err := v.LoadSSHKey()
+		if err != nil {
+			return nil, err
+		}
+		fileSigners = append(fileSigners, signer)
+	}
+	if !v.Remote.UseAgent {
+		if len(fileSigners) == 0 {
+			return nil, errors.New("neither Remote.UseAgent nor Remote.PrivateKeyPath is set")
+		}
+		return ssh.PublicKeys(fileSigners...), nil
+	}
+
+	sock := os.Getenv(agentSockEnv)
+	if sock == "" {
+		return nil, fmt.Errorf("Remote.UseAgent is set, but %s isn't", agentSockEnv)
+	}
+	a := &agentConn{sock: sock}
+	keys, err := a.list()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys in ssh-agent: %s", err)
+	}
+	if len(keys) == 0 && len(fileSigners) == 0 {
+		return nil, errors.New("ssh-agent has no keys")
+	}
+	// Only one publickey auth method is ever tried, so the keys of the agent
+	// and the key file are offered together.
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		agentSigners, err := a.signers()
+		if err != nil && len(fileSigners) == 0 {
+			return nil, fmt.Errorf("failed to get keys from ssh-agent: %s", err)
+		}
+		return append(agentSigners, fileSigners...), nil
+	}), nil
+}
+
+// agentConn is a connection to the ssh-agent at sock. The connection is kept
+// open for as long as the proxy runs, since new connections to the remote can
+// be made at any time, and it's made again if the agent went away in the
+// meantime, such as when it was restarted.
+type agentConn struct {
+	sock string
+
+	lock   sync.Mutex
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+// list returns the keys in the agent.
+func (a *agentConn) list() ([]*agent.Key, error) {
+	var keys []*agent.Key
+	err := a.do(func(client agent.ExtendedAgent) (err error) {
+		keys, err = client.List()
+		return err
+	})
+	return keys, err
+}
+
+// signers returns signers for the keys in the agent.
+func (a *agentConn) signers() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	err := a.do(func(client agent.ExtendedAgent) (err error) {
+		signers, err = client.Signers()
+		return err
+	})
+	return signers, err
+}
+
+// do calls fn with a client of the agent. If fn fails on a connection that
+// was already open, fn is tried once more on a new connection.
+func (a *agentConn) do(fn func(agent.ExtendedAgent) error) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.client != nil {
+		if err := fn(a.client); err == nil {
+			return nil
+		}
+		a.conn.Close()
+		a.conn, a.client = nil, nil
+	}
+	conn, err := net.Dial("unix", a.sock)
+	if err != nil {
+		return fmt.Errorf("failed to connect to ssh-agent: %s", err)
+	}
+	a.conn, a.client = conn, agent.NewClient(conn)
+	return fn(a.client)
+}
@@ -0,0 +1,234 @@
+package config_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/flawedmatrix/gocryptsftp/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var _ = Describe("RemoteAuth", func() {
+	var (
+		cfg        *config.Config
+		dir        string
+		sockPath   string
+		stopAgent  func()
+		keyring    agent.Agent
+		agentKey   ssh.PublicKey
+		oldSockEnv string
+	)
+
+	// authenticate performs an ssh handshake with auth against a server that
+	// accepts only the given key, and returns the key the client
+	// authenticated with.
+	authenticate := func(auth ssh.AuthMethod, accepted ssh.PublicKey) (ssh.PublicKey, error) {
+		_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		hostKey, err := ssh.NewSignerFromKey(hostPriv)
+		Expect(err).NotTo(HaveOccurred())
+
+		var usedKey ssh.PublicKey
+		serverConfig := &ssh.ServerConfig{
+			PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if string(key.Marshal()) != string(accepted.Marshal()) {
+					return nil, config.ErrProxyAuthRejected
+				}
+				usedKey = key
+				return nil, nil
+			},
+		}
+		serverConfig.AddHostKey(hostKey)
+
+		// Both ends of an ssh connection write before reading, so an
+		// unbuffered net.Pipe would deadlock.
+		serverListener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer serverListener.Close()
+		go func() {
+			serverConn, err := serverListener.Accept()
+			if err != nil {
+				return
+			}
+			defer serverConn.Close()
+			_, _, _, _ = ssh.NewServerConn(serverConn, serverConfig)
+		}()
+		clientConn, err := net.Dial("tcp", serverListener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer clientConn.Close()
+		c, _, _, err := ssh.NewClientConn(clientConn, "remote", &ssh.ClientConfig{
+			User:            "remote-user",
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.Close()
+		return usedKey, nil
+	}
+
+	// startAgent serves keyring at sockPath until the returned function is
+	// called, which also closes the connections to the agent.
+	startAgent := func() func() {
+		_ = os.Remove(sockPath)
+		listener, err := net.Listen("unix", sockPath)
+		Expect(err).NotTo(HaveOccurred())
+		var (
+			lock  sync.Mutex
+			conns []net.Conn
+		)
+		// The next spec replaces keyring, so the goroutines keep their own
+		// copy.
+		k := keyring
+		go func() {
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				lock.Lock()
+				conns = append(conns, c)
+				lock.Unlock()
+				go func() {
+					_ = agent.ServeAgent(k, c)
+				}()
+			}
+		}()
+		return func() {
+			listener.Close()
+			lock.Lock()
+			defer lock.Unlock()
+			for _, c := range conns {
+				c.Close()
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config-test-agent")
+		Expect(err).NotTo(HaveOccurred())
+
+		keyring = agent.NewKeyring()
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keyring.Add(agent.AddedKey{PrivateKey: priv})).To(Succeed())
+		signer, err := ssh.NewSignerFromKey(priv)
+		Expect(err).NotTo(HaveOccurred())
+		agentKey = signer.PublicKey()
+
+		sockPath = filepath.Join(dir, "agent.sock")
+		stopAgent = startAgent()
+
+		oldSockEnv = os.Getenv("SSH_AUTH_SOCK")
+		os.Setenv("SSH_AUTH_SOCK", sockPath)
+
+		cfg = &config.Config{
+			Remote: config.RemoteConfig{UseAgent: true},
+		}
+	})
+
+	AfterEach(func() {
+		stopAgent()
+		os.Setenv("SSH_AUTH_SOCK", oldSockEnv)
+		os.RemoveAll(dir)
+	})
+
+	It("authenticates with the keys in the agent", func() {
+		auth, err := cfg.RemoteAuth()
+		Expect(err).NotTo(HaveOccurred())
+
+		usedKey, err := authenticate(auth, agentKey)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usedKey.Marshal()).To(Equal(agentKey.Marshal()))
+	})
+
+	It("connects to the agent again after it was restarted", func() {
+		auth, err := cfg.RemoteAuth()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = authenticate(auth, agentKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		stopAgent()
+		stopAgent = startAgent()
+
+		usedKey, err := authenticate(auth, agentKey)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usedKey.Marshal()).To(Equal(agentKey.Marshal()))
+	})
+
+	Context("when a private key file is also configured", func() {
+		var (
+			privKeyPath string
+			fileKey     ssh.PublicKey
+		)
+
+		BeforeEach(func() {
+			// The keys from generatePrivateKey are too small to sign with.
+			_, priv, err := ed25519.GenerateKey(rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+			der, err := x509.MarshalPKCS8PrivateKey(priv)
+			Expect(err).NotTo(HaveOccurred())
+			privKeyPath = filepath.Join(dir, "id_ed25519")
+			keyBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+			Expect(ioutil.WriteFile(privKeyPath, keyBytes, 0600)).To(Succeed())
+			cfg.Remote.PrivateKeyPath = privKeyPath
+			signer, err := cfg.LoadSSHKey()
+			Expect(err).NotTo(HaveOccurred())
+			fileKey = signer.PublicKey()
+		})
+
+		It("falls back to the key file when the remote rejects the agent's keys", func() {
+			auth, err := cfg.RemoteAuth()
+			Expect(err).NotTo(HaveOccurred())
+
+			usedKey, err := authenticate(auth, fileKey)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(usedKey.Marshal()).To(Equal(fileKey.Marshal()))
+		})
+	})
+
+	Context("when the agent has no keys", func() {
+		BeforeEach(func() {
+			Expect(keyring.RemoveAll()).To(Succeed())
+		})
+
+		It("returns an error", func() {
+			_, err := cfg.RemoteAuth()
+			Expect(err).To(MatchError("ssh-agent has no keys"))
+		})
+	})
+
+	Context("when SSH_AUTH_SOCK isn't set", func() {
+		BeforeEach(func() {
+			os.Setenv("SSH_AUTH_SOCK", "")
+		})
+
+		It("returns an error", func() {
+			_, err := cfg.RemoteAuth()
+			Expect(err).To(MatchError(ContainSubstring("SSH_AUTH_SOCK")))
+		})
+	})
+
+	Context("when the agent isn't used", func() {
+		BeforeEach(func() {
+			cfg.Remote.UseAgent = false
+		})
+
+		It("requires a private key file", func() {
+			_, err := cfg.RemoteAuth()
+			Expect(err).To(MatchError(ContainSubstring("Remote.PrivateKeyPath")))
+		})
+	})
+})
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrProxyAuthRejected is returned when a proxy client fails to authenticate.
+var ErrProxyAuthRejected = errors.New("proxy authentication rejected")
+
+// unknownUserHash is checked against the passwords given for unknown users,
+// so that they take as long to reject as wrong passwords.
+const unknownUserHash = "$2a$10$kJCoJx7mbJTmNuZpIrETP.K8ChlWZfPFvN7QmGCOC9oF6bcMTySgm"
+
+// AuthorizedKeys is a set of public keys that proxy clients may authenticate
+// with, keyed by their wire format.
+type AuthorizedKeys map[string]bool
+
+// Contains returns true if key is in the set.
+func (a AuthorizedKeys) Contains(key ssh.PublicKey) bool {
+	return a[string(key.Marshal())]
+}
+
+// LoadAuthorizedKeys parses the authorized_keys file at AuthorizedKeysPath,
+// when no Users are configured.
+func (c *Config) LoadAuthorizedKeys() (AuthorizedKeys, error) {
+	return c.rootUser().LoadAuthorizedKeys()
+}
+
+// LoadAuthorizedKeys parses the authorized_keys file at AuthorizedKeysPath.
+// Options given for the keys in the file are ignored.
+func (u *UserConfig) LoadAuthorizedKeys() (AuthorizedKeys, error) {
+	keysBytes, err := ioutil.ReadFile(u.AuthorizedKeysPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load authorized keys: %s", err)
+	}
+	keys := AuthorizedKeys{}
+	for len(bytes.TrimSpace(keysBytes)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(keysBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse authorized keys %s: %s", u.AuthorizedKeysPath, err)
+		}
+		keys[string(key.Marshal())] = true
+		keysBytes = rest
+	}
+	return keys, nil
+}
+
+// FindUser returns the proxy user named user, or ErrProxyAuthRejected if
+// there's none. The name is compared to every user's in constant time.
+func (c *Config) FindUser(user string) (*UserConfig, error) {
+	var found *UserConfig
+	for _, u := range c.AllUsers() {
+		u := u
+		if subtle.ConstantTimeCompare([]byte(user), []byte(u.Name)) == 1 {
+			found = &u
+		}
+	}
+	if found == nil {
+		return nil, ErrProxyAuthRejected
+	}
+	return found, nil
+}
+
+// CheckProxyPassword returns ErrProxyAuthRejected unless user is a proxy
+// user with a password hash that pass matches.
+func (c *Config) CheckProxyPassword(user string, pass []byte) error {
+	u, userErr := c.FindUser(user)
+	// Always check a password, so that the time taken doesn't reveal
+	// whether the user name was correct, or whether the user can log in with
+	// a password at all.
+	hash := unknownUserHash
+	if userErr == nil && u.PasswordHash != "" {
+		hash = u.PasswordHash
+	}
+	passErr := bcrypt.CompareHashAndPassword([]byte(hash), pass)
+	if userErr != nil || u.PasswordHash == "" || passErr != nil {
+		return ErrProxyAuthRejected
+	}
+	return nil
+}
+
+// PromptPasswordHash prompts for a new proxy password twice and returns its
+// bcrypt hash, for use as ProxyPasswordHash.
+func PromptPasswordHash() (string, error) {
+	pass, err := pwReader.ReadPassword("Enter new proxy password: ")
+	if err != nil {
+		return "", err
+	}
+	if len(pass) == 0 {
+		return "", errors.New("password must not be empty")
+	}
+	confirm, err := pwReader.ReadPassword("Repeat proxy password: ")
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare(pass, confirm) != 1 {
+		return "", errors.New("passwords do not match")
+	}
+	hash, err := bcrypt.GenerateFromPassword(pass, bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
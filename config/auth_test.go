@@ -0,0 +1,171 @@
+package config_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/flawedmatrix/gocryptsftp/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("Auth", func() {
+	Describe("CheckProxyPassword", func() {
+		var cfg *config.Config
+
+		BeforeEach(func() {
+			hash, err := bcrypt.GenerateFromPassword([]byte("somepass"), bcrypt.MinCost)
+			Expect(err).NotTo(HaveOccurred())
+			cfg = &config.Config{
+				ProxyUser:         "someuser",
+				ProxyPasswordHash: string(hash),
+			}
+		})
+
+		It("accepts the configured user and password", func() {
+			Expect(cfg.CheckProxyPassword("someuser", []byte("somepass"))).To(Succeed())
+		})
+
+		It("rejects a wrong password", func() {
+			err := cfg.CheckProxyPassword("someuser", []byte("otherpass"))
+			Expect(err).To(MatchError(config.ErrProxyAuthRejected))
+		})
+
+		It("rejects a wrong user", func() {
+			err := cfg.CheckProxyPassword("otheruser", []byte("somepass"))
+			Expect(err).To(MatchError(config.ErrProxyAuthRejected))
+		})
+
+		Context("when no password hash is configured", func() {
+			BeforeEach(func() {
+				cfg.ProxyPasswordHash = ""
+			})
+
+			It("rejects every password", func() {
+				Expect(cfg.CheckProxyPassword("someuser", []byte(""))).To(MatchError(config.ErrProxyAuthRejected))
+			})
+
+			It("takes about as long as rejecting an unknown user", func() {
+				start := time.Now()
+				Expect(cfg.CheckProxyPassword("otheruser", []byte("somepass"))).NotTo(Succeed())
+				unknown := time.Since(start)
+
+				start = time.Now()
+				Expect(cfg.CheckProxyPassword("someuser", []byte("somepass"))).NotTo(Succeed())
+				Expect(time.Since(start)).To(BeNumerically(">", unknown/4))
+			})
+		})
+	})
+
+	Describe("LoadAuthorizedKeys", func() {
+		var (
+			cfg                 *config.Config
+			authorized, another ssh.PublicKey
+			keysBytes           []byte
+		)
+
+		generatePublicKey := func() ssh.PublicKey {
+			pub, _, err := ed25519.GenerateKey(rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+			key, err := ssh.NewPublicKey(pub)
+			Expect(err).NotTo(HaveOccurred())
+			return key
+		}
+
+		BeforeEach(func() {
+			authorized = generatePublicKey()
+			another = generatePublicKey()
+			keysBytes = append([]byte("# sync tooling\n\n"), ssh.MarshalAuthorizedKey(authorized)...)
+		})
+
+		JustBeforeEach(func() {
+			f, err := ioutil.TempFile("", "config-test-authorized-keys")
+			Expect(err).NotTo(HaveOccurred())
+			defer f.Close()
+			_, err = f.Write(keysBytes)
+			Expect(err).NotTo(HaveOccurred())
+			cfg = &config.Config{AuthorizedKeysPath: f.Name()}
+		})
+
+		AfterEach(func() {
+			os.Remove(cfg.AuthorizedKeysPath)
+		})
+
+		It("loads the keys in the file", func() {
+			keys, err := cfg.LoadAuthorizedKeys()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys.Contains(authorized)).To(BeTrue())
+			Expect(keys.Contains(another)).To(BeFalse())
+		})
+
+		Context("when the file has multiple keys with options", func() {
+			BeforeEach(func() {
+				keysBytes = append(keysBytes, []byte("no-pty ")...)
+				keysBytes = append(keysBytes, ssh.MarshalAuthorizedKey(another)...)
+			})
+
+			It("loads all of them", func() {
+				keys, err := cfg.LoadAuthorizedKeys()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(keys).To(HaveLen(2))
+				Expect(keys.Contains(another)).To(BeTrue())
+			})
+		})
+
+		Context("when the file has an invalid key", func() {
+			BeforeEach(func() {
+				keysBytes = append(keysBytes, []byte("ssh-ed25519 garbage\n")...)
+			})
+
+			It("returns an error", func() {
+				keys, err := cfg.LoadAuthorizedKeys()
+				Expect(err).To(HaveOccurred())
+				Expect(keys).To(BeNil())
+			})
+		})
+	})
+
+	Describe("PromptPasswordHash", func() {
+		var pwReader *config.FakePasswordReader
+
+		BeforeEach(func() {
+			pwReader = config.SetTestPWReader()
+			pwReader.ReadPasswordReturns([]byte("newpass"), nil)
+		})
+
+		It("returns a bcrypt hash of the password", func() {
+			hash, err := config.PromptPasswordHash()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bcrypt.CompareHashAndPassword([]byte(hash), []byte("newpass"))).To(Succeed())
+			Expect(pwReader.ReadPasswordCallCount()).To(Equal(2))
+		})
+
+		Context("when the passwords don't match", func() {
+			BeforeEach(func() {
+				pwReader.ReadPasswordReturnsOnCall(1, []byte("otherpass"), nil)
+			})
+
+			It("returns an error", func() {
+				_, err := config.PromptPasswordHash()
+				Expect(err).To(MatchError("passwords do not match"))
+			})
+		})
+
+		Context("when reading the password fails", func() {
+			BeforeEach(func() {
+				pwReader.ReadPasswordReturns(nil, errors.New("boom"))
+			})
+
+			It("returns the error", func() {
+				_, err := config.PromptPasswordHash()
+				Expect(err).To(MatchError("boom"))
+			})
+		})
+	})
+})
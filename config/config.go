@@ -4,29 +4,119 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"syscall"
 
-	"gopkg.in/go-playground/validator.v9"
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+	"github.com/flawedmatrix/gocryptsftp/requester"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 type RemoteConfig struct {
-	Addr           string `validate:"required"`
-	FileRoot       string `validate:"required"`
-	User           string `validate:"required"`
-	PrivateKeyPath string `validate:"required,file"`
+	Addr     string `validate:"required"`
+	FileRoot string `validate:"required"`
+	User     string `validate:"required"`
+	// PrivateKeyPath is the key used to connect to the remote. It's optional
+	// when UseAgent is set.
+	PrivateKeyPath string `validate:"required_without=UseAgent,omitempty,file"`
+	// UseAgent offers the keys in the ssh-agent at SSH_AUTH_SOCK to the
+	// remote, before the key at PrivateKeyPath.
+	UseAgent bool
+	// Local serves FileRoot from the local filesystem, such as a mounted
+	// network share, instead of connecting to a remote. Addr, User and the
+	// keys aren't needed then.
+	Local bool
+}
+
+// CacheLimits bounds one of the caches kept for requests to the remote. A
+// zero value for any of the fields means that dimension is unbounded.
+type CacheLimits struct {
+	MaxEntries int   `validate:"min=0"`
+	MaxBytes   int64 `validate:"min=0"`
+	TTL        Duration
+}
+
+type CacheConfig struct {
+	// File bounds the cache of small files such as directory IVs.
+	File CacheLimits
+	// Dir bounds the cache of directory listings.
+	Dir CacheLimits
+	// Decrypt bounds the cache of decrypted names.
+	Decrypt CacheLimits
+	// RevalidateInterval is how often a directory is checked on the remote
+	// for changes made by other clients. Zero turns off the checks.
+	RevalidateInterval Duration
 }
 
 type Config struct {
-	ProxyUser      string `validate:"required"`
-	ProxyPassword  string `validate:"required"`
-	KnownHostsPath string `validate:"required,file"`
+	// ProxyUser, ProxyPasswordHash and AuthorizedKeysPath describe the single
+	// proxy user, when no Users are configured.
+	ProxyUser string `validate:"required"`
+	// ProxyPasswordHash is a bcrypt hash of the password proxy clients may
+	// authenticate with.
+	ProxyPasswordHash string `validate:"required_without=AuthorizedKeysPath"`
+	// AuthorizedKeysPath is an authorized_keys file with the public keys
+	// proxy clients may authenticate with.
+	AuthorizedKeysPath string `validate:"required_without=ProxyPasswordHash,omitempty,file"`
+	KnownHostsPath     string `validate:"required,file"`
+	// HostKeyPath is the private key the proxy identifies itself to proxy
+	// clients with. It defaults to DefaultHostKeyName next to the config
+	// file, and is generated if it doesn't exist.
+	HostKeyPath string
+
+	Server ServerConfig
+	// Remote and Passphrases describe the single volume served at the root,
+	// when no Volumes are configured.
+	Remote      RemoteConfig      `validate:"-"`
+	Passphrases PassphrasesConfig `validate:"-"`
+	// Volumes are served as top-level directories named after them.
+	Volumes []VolumeConfig `validate:"-"`
+	// Users are the proxy users, each confined to part of the served files.
+	Users []UserConfig `validate:"-"`
+	Cache CacheConfig
+}
+
+// DefaultCacheConfig returns the cache limits used for any that are left out
+// of the config file.
+func DefaultCacheConfig() CacheConfig {
+	defaults := requester.DefaultLimits()
+	return CacheConfig{
+		File:    cacheLimitsFrom(defaults.File),
+		Dir:     cacheLimitsFrom(defaults.Dir),
+		Decrypt: cacheLimitsFrom(defaults.Decrypt),
+
+		RevalidateInterval: Duration{filetree.DefaultOptions().RevalidateInterval},
+	}
+}
+
+// RequesterLimits converts the cache config to limits for a requester.
+func (c CacheConfig) RequesterLimits() requester.Limits {
+	return requester.Limits{
+		File:    c.File.requesterLimits(),
+		Dir:     c.Dir.requesterLimits(),
+		Decrypt: c.Decrypt.requesterLimits(),
+	}
+}
 
-	Remote RemoteConfig
+func cacheLimitsFrom(l requester.CacheLimits) CacheLimits {
+	return CacheLimits{
+		MaxEntries: l.MaxEntries,
+		MaxBytes:   l.MaxBytes,
+		TTL:        Duration{l.TTL},
+	}
+}
+
+func (c CacheLimits) requesterLimits() requester.CacheLimits {
+	return requester.CacheLimits{
+		MaxEntries: c.MaxEntries,
+		MaxBytes:   c.MaxBytes,
+		TTL:        c.TTL.Duration,
+	}
 }
 
 type PasswordReader interface {
@@ -49,28 +139,58 @@ func LoadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	cfg := Config{}
+	cfg := Config{Server: DefaultServerConfig(), Cache: DefaultCacheConfig()}
 	err = json.Unmarshal(configBytes, &cfg)
 	if err != nil {
 		return nil, err
 	}
+	var legacy struct{ ProxyPassword *string }
+	if err := json.Unmarshal(configBytes, &legacy); err == nil && legacy.ProxyPassword != nil {
+		return nil, errors.New("ProxyPassword is no longer supported, set ProxyPasswordHash to a bcrypt hash of the password instead")
+	}
+	if cfg.HostKeyPath == "" {
+		cfg.HostKeyPath = filepath.Join(filepath.Dir(path), DefaultHostKeyName)
+	}
 	return &cfg, nil
 }
 
+// Validate checks the whole config. The returned error is a *ValidationError
+// listing every invalid field.
 func (c *Config) Validate() error {
-	validate := validator.New()
-	return validate.Struct(c)
+	var p problems
+	if len(c.Users) == 0 {
+		p.addStruct("", c)
+	} else {
+		p.addStruct("", c, rootUserFields...)
+	}
+	p.add(c.Server.checkListenAddr("Server.ListenAddr"))
+	c.validateVolumes(&p)
+	c.validateUsers(&p)
+	return p.err()
 }
 
+// LoadSSHKey loads the key at Remote.PrivateKeyPath of the volume served at
+// the root.
 func (c *Config) LoadSSHKey() (ssh.Signer, error) {
-	privateBytes, err := ioutil.ReadFile(c.Remote.PrivateKeyPath)
+	return c.rootVolume().LoadSSHKey()
+}
+
+// LoadSSHKey loads the key at Remote.PrivateKeyPath, reading its passphrase
+// from Passphrases.PrivateKey if it's encrypted.
+func (v *VolumeConfig) LoadSSHKey() (ssh.Signer, error) {
+	privateBytes, err := ioutil.ReadFile(v.Remote.PrivateKeyPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load private key: %s", err)
 	}
 	if isPrivateKeyEncrypted(privateBytes) {
-		for i := 0; i < 3; i++ {
-			prompt := fmt.Sprintf("Enter passphrase for key '%s': ", c.Remote.PrivateKeyPath)
-			passphrase, err := pwReader.ReadPassword(prompt)
+		source := v.Passphrases.PrivateKey
+		attempts := 1
+		if source.interactive() {
+			attempts = 3
+		}
+		for i := 0; i < attempts; i++ {
+			prompt := fmt.Sprintf("Enter passphrase for key '%s': ", v.Remote.PrivateKeyPath)
+			passphrase, err := source.reader().ReadPassword(prompt)
 			if err != nil {
 				return nil, err
 			}
@@ -92,7 +212,15 @@ func isPrivateKeyEncrypted(key []byte) bool {
 	return x509.IsEncryptedPEMBlock(block)
 }
 
+// GetDecrpytionPassphrase reads the passphrase of the volume served at the
+// root.
 func (c *Config) GetDecrpytionPassphrase() ([]byte, error) {
-	prompt := fmt.Sprintf("Enter passphrase for gocryptfs root at '%s': ", c.Remote.FileRoot)
-	return pwReader.ReadPassword(prompt)
+	return c.rootVolume().GetDecrpytionPassphrase()
+}
+
+// GetDecrpytionPassphrase reads the passphrase of the gocryptfs root at
+// Remote.FileRoot from Passphrases.Decryption.
+func (v *VolumeConfig) GetDecrpytionPassphrase() ([]byte, error) {
+	prompt := fmt.Sprintf("Enter passphrase for gocryptfs root at '%s:%s': ", v.Remote.Addr, v.Remote.FileRoot)
+	return v.Passphrases.Decryption.reader().ReadPassword(prompt)
 }
@@ -27,7 +27,7 @@ var _ = Describe("Config", func() {
 		BeforeEach(func() {
 			jsonBytes = []byte(`{
 				"ProxyUser": "someuser",
-				"ProxyPassword": "somepass",
+				"ProxyPasswordHash": "$2a$04$flHPmYtM6LKZP.O0TBEl2uZKzR5s76JxGI/Cp7ObBvx3biO2wV8yC",
 				"KnownHostsPath": "/path/that/exists",
 				"Remote": {
 					"Addr": "remote.addr.com:22",
@@ -63,6 +63,113 @@ var _ = Describe("Config", func() {
 			Expect(cfg).To(BeNil())
 		})
 
+		It("puts the host key next to the config file when no path is configured", func() {
+			cfg, err := config.LoadConfig(configFilePath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.HostKeyPath).To(Equal(filepath.Join(filepath.Dir(configFilePath), config.DefaultHostKeyName)))
+		})
+
+		Context("when a host key path is configured", func() {
+			BeforeEach(func() {
+				jsonBytes = []byte(`{"HostKeyPath": "/some/host/key"}`)
+			})
+
+			It("uses it", func() {
+				cfg, err := config.LoadConfig(configFilePath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cfg.HostKeyPath).To(Equal("/some/host/key"))
+			})
+		})
+
+		It("uses the default server settings when none are configured", func() {
+			cfg, err := config.LoadConfig(configFilePath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Server).To(Equal(config.DefaultServerConfig()))
+		})
+
+		Context("when server settings are configured", func() {
+			BeforeEach(func() {
+				jsonBytes = []byte(`{"Server": {"ListenAddr": "unix:/tmp/proxy.sock", "Workers": 8}}`)
+			})
+
+			It("loads them, keeping the defaults for anything left out", func() {
+				cfg, err := config.LoadConfig(configFilePath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cfg.Server.ListenAddr).To(Equal("unix:/tmp/proxy.sock"))
+				Expect(cfg.Server.Workers).To(Equal(8))
+				Expect(cfg.Server.PoolCapacity).To(Equal(config.DefaultServerConfig().PoolCapacity))
+			})
+		})
+
+		Context("when server settings are invalid", func() {
+			BeforeEach(func() {
+				jsonBytes = []byte(`{"Server": {"ListenAddr": "localhost"}}`)
+			})
+
+			It("loads them and reports them when validating", func() {
+				cfg, err := config.LoadConfig(configFilePath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cfg.Validate()).To(MatchError(ContainSubstring("Server.ListenAddr")))
+			})
+		})
+
+		It("uses the default cache limits when none are configured", func() {
+			cfg, err := config.LoadConfig(configFilePath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Cache).To(Equal(config.DefaultCacheConfig()))
+		})
+
+		Context("when cache limits are configured", func() {
+			BeforeEach(func() {
+				jsonBytes = []byte(`{
+					"ProxyUser": "someuser",
+					"Cache": {
+						"Dir": {"MaxEntries": 50, "MaxBytes": 1000, "TTL": "90s"},
+						"Decrypt": {"MaxEntries": 0},
+						"RevalidateInterval": "5s"
+					}
+				}`)
+			})
+
+			It("loads them, keeping the defaults for anything left out", func() {
+				cfg, err := config.LoadConfig(configFilePath)
+				Expect(err).ToNot(HaveOccurred())
+
+				limits := cfg.Cache.RequesterLimits()
+				Expect(limits.Dir.MaxEntries).To(Equal(50))
+				Expect(limits.Dir.MaxBytes).To(Equal(int64(1000)))
+				Expect(limits.Dir.TTL).To(Equal(90 * time.Second))
+				Expect(limits.Decrypt.MaxEntries).To(BeZero())
+				Expect(limits.Decrypt.MaxBytes).To(Equal(config.DefaultCacheConfig().Decrypt.MaxBytes))
+				Expect(cfg.Cache.File).To(Equal(config.DefaultCacheConfig().File))
+				Expect(cfg.Cache.RevalidateInterval.Duration).To(Equal(5 * time.Second))
+			})
+		})
+
+		Context("when a cache TTL is invalid", func() {
+			BeforeEach(func() {
+				jsonBytes = []byte(`{"Cache": {"File": {"TTL": "-5s"}}}`)
+			})
+
+			It("returns an error", func() {
+				cfg, err := config.LoadConfig(configFilePath)
+				Expect(err).To(MatchError(ContainSubstring("negative")))
+				Expect(cfg).To(BeNil())
+			})
+		})
+
+		Context("when a cleartext proxy password is configured", func() {
+			BeforeEach(func() {
+				jsonBytes = []byte(`{"ProxyUser": "someuser", "ProxyPassword": "somepass"}`)
+			})
+
+			It("returns an error asking for a hash instead", func() {
+				cfg, err := config.LoadConfig(configFilePath)
+				Expect(err).To(MatchError(ContainSubstring("ProxyPasswordHash")))
+				Expect(cfg).To(BeNil())
+			})
+		})
+
 		Context("when the json is invalid", func() {
 			BeforeEach(func() {
 				jsonBytes = []byte(`{"invalid-json`)
@@ -81,9 +188,10 @@ var _ = Describe("Config", func() {
 
 		BeforeEach(func() {
 			cfg = &config.Config{
-				ProxyUser:      "someuser",
-				ProxyPassword:  "somepass",
-				KnownHostsPath: os.Args[0],
+				ProxyUser:         "someuser",
+				ProxyPasswordHash: "$2a$04$flHPmYtM6LKZP.O0TBEl2uZKzR5s76JxGI/Cp7ObBvx3biO2wV8yC",
+				KnownHostsPath:    os.Args[0],
+				Server:            config.DefaultServerConfig(),
 				Remote: config.RemoteConfig{
 					Addr:           "remote.addr.com:22",
 					FileRoot:       "/some/file/root",
@@ -107,6 +215,99 @@ var _ = Describe("Config", func() {
 			})
 		})
 
+		Context("when several fields are invalid", func() {
+			BeforeEach(func() {
+				cfg.Remote.FileRoot = ""
+				cfg.KnownHostsPath = "/nonexistent"
+				cfg.Server.Workers = 0
+				cfg.Server.ListenAddr = "localhost"
+			})
+
+			It("reports all of them at once", func() {
+				err := cfg.Validate()
+				var validationErr *config.ValidationError
+				Expect(errors.As(err, &validationErr)).To(BeTrue())
+				Expect(validationErr.Problems).To(ConsistOf(
+					"Remote.FileRoot is required",
+					`KnownHostsPath: no file at "/nonexistent"`,
+					"Server.Workers must be at least 1",
+					ContainSubstring("Server.ListenAddr"),
+				))
+			})
+		})
+
+		Context("when the ssh-agent is used instead of a private key", func() {
+			BeforeEach(func() {
+				cfg.Remote.PrivateKeyPath = ""
+				cfg.Remote.UseAgent = true
+			})
+
+			It("successfully validates", func() {
+				Expect(cfg.Validate()).To(Succeed())
+			})
+		})
+
+		Context("when neither the ssh-agent nor a private key is configured", func() {
+			BeforeEach(func() {
+				cfg.Remote.PrivateKeyPath = ""
+			})
+
+			It("fails validation", func() {
+				Expect(cfg.Validate()).To(MatchError(ContainSubstring("Remote.PrivateKeyPath is required when UseAgent isn't set")))
+			})
+		})
+
+		Context("when only authorized keys are configured", func() {
+			BeforeEach(func() {
+				cfg.ProxyPasswordHash = ""
+				cfg.AuthorizedKeysPath = os.Args[0]
+			})
+
+			It("successfully validates", func() {
+				Expect(cfg.Validate()).To(Succeed())
+			})
+		})
+
+		Context("when neither a password hash nor authorized keys are configured", func() {
+			BeforeEach(func() {
+				cfg.ProxyPasswordHash = ""
+			})
+
+			It("fails validation", func() {
+				Expect(cfg.Validate()).To(MatchError(ContainSubstring("ProxyPasswordHash")))
+			})
+		})
+
+		Context("when the password hash isn't a bcrypt hash", func() {
+			BeforeEach(func() {
+				cfg.ProxyPasswordHash = "somepass"
+			})
+
+			It("fails validation", func() {
+				Expect(cfg.Validate()).To(MatchError(ContainSubstring("ProxyPasswordHash")))
+			})
+		})
+
+		Context("when the authorized keys file doesn't exist", func() {
+			BeforeEach(func() {
+				cfg.AuthorizedKeysPath = "/nonexistent"
+			})
+
+			It("fails validation", func() {
+				Expect(cfg.Validate()).To(MatchError(ContainSubstring("AuthorizedKeysPath")))
+			})
+		})
+
+		Context("when a cache limit is negative", func() {
+			BeforeEach(func() {
+				cfg.Cache.Dir.MaxEntries = -1
+			})
+
+			It("fails validation", func() {
+				Expect(cfg.Validate()).To(MatchError(ContainSubstring("MaxEntries")))
+			})
+		})
+
 		Context("when a required file is present but the path doesn't exist", func() {
 			BeforeEach(func() {
 				cfg.KnownHostsPath = "/nonexistent"
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultHostKeyName is the name of the host key file created next to the
+// config file when HostKeyPath isn't set.
+const DefaultHostKeyName = "gocryptsftp_host_ed25519_key"
+
+// LoadHostKey loads the host key the proxy identifies itself with from
+// HostKeyPath. If the file doesn't exist yet, a new ed25519 key is generated
+// and saved there first. The returned bool is true if a key was generated.
+func (c *Config) LoadHostKey() (ssh.Signer, bool, error) {
+	keyBytes, err := ioutil.ReadFile(c.HostKeyPath)
+	if os.IsNotExist(err) {
+		signer, err := generateHostKey(c.HostKeyPath)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to generate host key: %s", err)
+		}
+		return signer, true, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load host key: %s", err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse host key %s: %s", c.HostKeyPath, err)
+	}
+	return signer, false, nil
+}
+
+func generateHostKey(path string) (ssh.Signer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	// O_EXCL makes sure a key written by someone else in the meantime isn't
+	// replaced.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(keyBytes)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(priv)
+}
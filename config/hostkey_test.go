@@ -0,0 +1,96 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/flawedmatrix/gocryptsftp/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("LoadHostKey", func() {
+	var (
+		dir string
+		cfg *config.Config
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config-test-host-key")
+		Expect(err).NotTo(HaveOccurred())
+		cfg = &config.Config{HostKeyPath: filepath.Join(dir, config.DefaultHostKeyName)}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Context("when the host key doesn't exist", func() {
+		It("generates an ed25519 key only readable by the owner", func() {
+			signer, generated, err := cfg.LoadHostKey()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(generated).To(BeTrue())
+			Expect(signer.PublicKey().Type()).To(Equal(ssh.KeyAlgoED25519))
+
+			info, err := os.Stat(cfg.HostKeyPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("loads the same key on the next start", func() {
+			first, _, err := cfg.LoadHostKey()
+			Expect(err).NotTo(HaveOccurred())
+
+			second, generated, err := cfg.LoadHostKey()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(generated).To(BeFalse())
+			Expect(second.PublicKey().Marshal()).To(Equal(first.PublicKey().Marshal()))
+		})
+	})
+
+	Context("when the host key exists", func() {
+		var keyPath string
+
+		BeforeEach(func() {
+			keyPath, _ = generatePrivateKey(false)
+			cfg.HostKeyPath = keyPath
+		})
+
+		AfterEach(func() {
+			os.Remove(keyPath)
+		})
+
+		It("loads it", func() {
+			signer, generated, err := cfg.LoadHostKey()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(generated).To(BeFalse())
+			Expect(signer.PublicKey().Type()).To(Equal(ssh.KeyAlgoRSA))
+		})
+	})
+
+	Context("when the host key can't be parsed", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(cfg.HostKeyPath, []byte("garbage"), 0600)).To(Succeed())
+		})
+
+		It("returns an error without replacing it", func() {
+			_, _, err := cfg.LoadHostKey()
+			Expect(err).To(MatchError(ContainSubstring("failed to parse host key")))
+			Expect(ioutil.ReadFile(cfg.HostKeyPath)).To(Equal([]byte("garbage")))
+		})
+	})
+
+	Context("when the host key can't be written", func() {
+		BeforeEach(func() {
+			cfg.HostKeyPath = filepath.Join(dir, "nonexistent", config.DefaultHostKeyName)
+		})
+
+		It("returns an error", func() {
+			_, _, err := cfg.LoadHostKey()
+			Expect(err).To(MatchError(ContainSubstring("failed to generate host key")))
+		})
+	})
+})
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// maxPassphraseLen is the longest passphrase read from a non-interactive
+// source, which protects against accidentally pointing a source at a large
+// file.
+const maxPassphraseLen = 2048
+
+// PassphraseSource says where a passphrase is read from. At most one of the
+// fields may be set. If none are, the passphrase is prompted for on the
+// terminal.
+type PassphraseSource struct {
+	// File is the path of a file holding the passphrase.
+	File string
+	// FD is an open file descriptor the passphrase is read from, such as a
+	// pipe set up by a service manager. It can only be read once.
+	FD *int
+	// Env is the name of an environment variable holding the passphrase.
+	Env string
+	// Command is a program and its arguments that prints the passphrase to
+	// stdout, like the -extpass option of gocryptfs.
+	Command []string
+}
+
+// PassphrasesConfig says where the passphrases needed at startup are read
+// from.
+type PassphrasesConfig struct {
+	// PrivateKey is the passphrase of Remote.PrivateKeyPath, if it's
+	// encrypted.
+	PrivateKey PassphraseSource
+	// Decryption is the passphrase of the gocryptfs root at Remote.FileRoot.
+	Decryption PassphraseSource
+}
+
+// validate checks that at most one source is set. The source is referred to
+// as field in the returned error.
+func (s PassphraseSource) validate(field string) error {
+	set := 0
+	for _, isSet := range []bool{s.File != "", s.FD != nil, s.Env != "", len(s.Command) > 0} {
+		if isSet {
+			set++
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("%s must only set one of File, FD, Env and Command", field)
+	}
+	return nil
+}
+
+// interactive returns true if the passphrase is prompted for.
+func (s PassphraseSource) interactive() bool {
+	return s.File == "" && s.FD == nil && s.Env == "" && len(s.Command) == 0
+}
+
+// reader returns the PasswordReader for the source.
+func (s PassphraseSource) reader() PasswordReader {
+	switch {
+	case s.File != "":
+		return filePasswordReader{path: s.File}
+	case s.FD != nil:
+		return fdPasswordReader{fd: *s.FD}
+	case s.Env != "":
+		return envPasswordReader{name: s.Env}
+	case len(s.Command) > 0:
+		return commandPasswordReader{argv: s.Command}
+	default:
+		return pwReader
+	}
+}
+
+type filePasswordReader struct {
+	path string
+}
+
+func (f filePasswordReader) ReadPassword(prompt string) ([]byte, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open passphrase file: %s", err)
+	}
+	defer file.Close()
+	return readPassphrase(file, fmt.Sprintf("file %s", f.path))
+}
+
+type fdPasswordReader struct {
+	fd int
+}
+
+func (f fdPasswordReader) ReadPassword(prompt string) ([]byte, error) {
+	file := os.NewFile(uintptr(f.fd), fmt.Sprintf("fd %d", f.fd))
+	if file == nil {
+		return nil, fmt.Errorf("invalid passphrase fd %d", f.fd)
+	}
+	defer file.Close()
+	return readPassphrase(file, fmt.Sprintf("fd %d", f.fd))
+}
+
+type envPasswordReader struct {
+	name string
+}
+
+func (e envPasswordReader) ReadPassword(prompt string) ([]byte, error) {
+	pass, found := os.LookupEnv(e.name)
+	if !found {
+		return nil, fmt.Errorf("passphrase environment variable %s is not set", e.name)
+	}
+	return readPassphrase(bytes.NewReader([]byte(pass)), fmt.Sprintf("environment variable %s", e.name))
+}
+
+type commandPasswordReader struct {
+	argv []string
+}
+
+func (c commandPasswordReader) ReadPassword(prompt string) ([]byte, error) {
+	cmd := exec.Command(c.argv[0], c.argv[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("passphrase command %s failed: %s", c.argv[0], err)
+	}
+	return readPassphrase(bytes.NewReader(out), fmt.Sprintf("command %s", c.argv[0]))
+}
+
+// readPassphrase reads a passphrase from r, without the trailing newline.
+// source describes r in errors.
+func readPassphrase(r io.Reader, source string) ([]byte, error) {
+	pass, err := ioutil.ReadAll(io.LimitReader(r, maxPassphraseLen+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase from %s: %s", source, err)
+	}
+	if len(pass) > maxPassphraseLen {
+		return nil, fmt.Errorf("passphrase from %s is longer than %d bytes", source, maxPassphraseLen)
+	}
+	pass = bytes.TrimSuffix(pass, []byte("\n"))
+	pass = bytes.TrimSuffix(pass, []byte("\r"))
+	if len(pass) == 0 {
+		return nil, fmt.Errorf("passphrase from %s is empty", source)
+	}
+	return pass, nil
+}
@@ -0,0 +1,221 @@
+package config_test
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/flawedmatrix/gocryptsftp/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Passphrase sources", func() {
+	var (
+		cfg      *config.Config
+		pwReader *config.FakePasswordReader
+	)
+
+	BeforeEach(func() {
+		pwReader = config.SetTestPWReader()
+		pwReader.ReadPasswordReturns([]byte("prompted"), nil)
+
+		cfg = &config.Config{
+			Remote: config.RemoteConfig{
+				FileRoot: "/some/file/root",
+			},
+		}
+	})
+
+	writeTempFile := func(content string) string {
+		f, err := ioutil.TempFile("", "config-test-passphrase")
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+		_, err = f.WriteString(content)
+		Expect(err).NotTo(HaveOccurred())
+		return f.Name()
+	}
+
+	It("prompts when no source is configured", func() {
+		pass, err := cfg.GetDecrpytionPassphrase()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pass).To(Equal([]byte("prompted")))
+	})
+
+	Context("when reading from a file", func() {
+		var path string
+
+		BeforeEach(func() {
+			path = writeTempFile("from-file\n")
+			cfg.Passphrases.Decryption.File = path
+		})
+
+		AfterEach(func() {
+			os.Remove(path)
+		})
+
+		It("reads the passphrase without the trailing newline", func() {
+			pass, err := cfg.GetDecrpytionPassphrase()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pass).To(Equal([]byte("from-file")))
+			Expect(pwReader.ReadPasswordCallCount()).To(BeZero())
+		})
+
+		Context("when the file is empty", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(path, []byte("\n"), 0600)).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				_, err := cfg.GetDecrpytionPassphrase()
+				Expect(err).To(MatchError(ContainSubstring("empty")))
+			})
+		})
+
+		Context("when the file is too large to be a passphrase", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(path, []byte(strings.Repeat("a", 4096)), 0600)).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				_, err := cfg.GetDecrpytionPassphrase()
+				Expect(err).To(MatchError(ContainSubstring("longer than")))
+			})
+		})
+
+		Context("when the file doesn't exist", func() {
+			BeforeEach(func() {
+				cfg.Passphrases.Decryption.File = "/nonexistent"
+			})
+
+			It("returns an error", func() {
+				_, err := cfg.GetDecrpytionPassphrase()
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Context("when reading from a file descriptor", func() {
+		BeforeEach(func() {
+			r, w, err := os.Pipe()
+			Expect(err).NotTo(HaveOccurred())
+			defer r.Close()
+			_, err = w.WriteString("from-fd")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.Close()).To(Succeed())
+			// The reader closes the fd it's given, so give it its own.
+			fd, err := syscall.Dup(int(r.Fd()))
+			Expect(err).NotTo(HaveOccurred())
+			cfg.Passphrases.Decryption.FD = &fd
+		})
+
+		It("reads the passphrase", func() {
+			pass, err := cfg.GetDecrpytionPassphrase()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pass).To(Equal([]byte("from-fd")))
+		})
+	})
+
+	Context("when reading from an environment variable", func() {
+		BeforeEach(func() {
+			os.Setenv("GOCRYPTSFTP_TEST_PASSPHRASE", "from-env")
+			cfg.Passphrases.Decryption.Env = "GOCRYPTSFTP_TEST_PASSPHRASE"
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("GOCRYPTSFTP_TEST_PASSPHRASE")
+		})
+
+		It("reads the passphrase", func() {
+			pass, err := cfg.GetDecrpytionPassphrase()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pass).To(Equal([]byte("from-env")))
+		})
+
+		Context("when the variable isn't set", func() {
+			BeforeEach(func() {
+				os.Unsetenv("GOCRYPTSFTP_TEST_PASSPHRASE")
+			})
+
+			It("returns an error", func() {
+				_, err := cfg.GetDecrpytionPassphrase()
+				Expect(err).To(MatchError(ContainSubstring("not set")))
+			})
+		})
+	})
+
+	Context("when reading from a command", func() {
+		BeforeEach(func() {
+			cfg.Passphrases.Decryption.Command = []string{"echo", "from-command"}
+		})
+
+		It("reads the passphrase from its output", func() {
+			pass, err := cfg.GetDecrpytionPassphrase()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pass).To(Equal([]byte("from-command")))
+		})
+
+		Context("when the command fails", func() {
+			BeforeEach(func() {
+				cfg.Passphrases.Decryption.Command = []string{"false"}
+			})
+
+			It("returns an error", func() {
+				_, err := cfg.GetDecrpytionPassphrase()
+				Expect(err).To(MatchError(ContainSubstring("passphrase command false failed")))
+			})
+		})
+	})
+
+	Context("when the private key passphrase is read from a source", func() {
+		var (
+			privKeyPath   string
+			keyPassphrase []byte
+			passPath      string
+		)
+
+		BeforeEach(func() {
+			privKeyPath, keyPassphrase = generatePrivateKey(true)
+			passPath = writeTempFile(string(keyPassphrase))
+			cfg.Remote.PrivateKeyPath = privKeyPath
+			cfg.Passphrases.PrivateKey.File = passPath
+		})
+
+		AfterEach(func() {
+			os.Remove(privKeyPath)
+			os.Remove(passPath)
+		})
+
+		It("loads the encrypted key", func() {
+			sig, err := cfg.LoadSSHKey()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sig).NotTo(BeNil())
+			Expect(pwReader.ReadPasswordCallCount()).To(BeZero())
+		})
+
+		Context("when the passphrase is incorrect", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(passPath, []byte("wrong-password"), 0600)).To(Succeed())
+			})
+
+			It("fails without retrying or prompting", func() {
+				_, err := cfg.LoadSSHKey()
+				Expect(err).To(MatchError(x509.IncorrectPasswordError))
+				Expect(pwReader.ReadPasswordCallCount()).To(BeZero())
+			})
+		})
+	})
+
+	Context("when a passphrase has more than one source", func() {
+		BeforeEach(func() {
+			cfg.Passphrases.PrivateKey.Env = "SOME_VAR"
+			cfg.Passphrases.PrivateKey.Command = []string{"echo"}
+		})
+
+		It("fails validation", func() {
+			Expect(cfg.Validate()).To(MatchError(ContainSubstring("Passphrases.PrivateKey must only set one of")))
+		})
+	})
+})
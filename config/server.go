@@ -0,0 +1,154 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flawedmatrix/gocryptsftp/backend"
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+	"github.com/flawedmatrix/gocryptsftp/requester"
+)
+
+// unixPrefix marks a listen address as the path of a unix socket.
+const unixPrefix = "unix:"
+
+// ServerConfig holds the settings of the proxy server itself.
+type ServerConfig struct {
+	// ListenAddr is the address proxy clients connect to. It's either a TCP
+	// host:port, such as "127.0.0.1:9022" to only accept local connections,
+	// or the path of a unix socket prefixed with "unix:".
+	ListenAddr string `validate:"required"`
+	// Workers is the number of requests made to the remote in parallel.
+	Workers int `validate:"min=1"`
+	// PoolCapacity is the number of idle connections kept open to the remote.
+	PoolCapacity int `validate:"min=1"`
+	// MaxConnections is the number of connections that can be open to the
+	// remote at once. Zero means no limit.
+	MaxConnections int `validate:"min=0"`
+	// AcquireTimeout is how long a request waits for a connection to the
+	// remote once MaxConnections are in use. Zero waits for as long as it
+	// takes.
+	AcquireTimeout Duration
+	// KeepaliveInterval is how often idle connections to the remote are
+	// checked, so that dead ones get replaced. Zero turns off the checks.
+	KeepaliveInterval Duration
+	// KeepaliveTimeout is how long a connection to the remote is given to
+	// answer a check before it's replaced. Zero uses the default.
+	KeepaliveTimeout Duration
+	// IdleTimeout is how long an unused connection to the remote is kept
+	// open. Zero keeps them open.
+	IdleTimeout Duration
+	// RetryAttempts is the number of times a read from the remote that fails
+	// transiently, such as when its connection is reset, is attempted.
+	RetryAttempts int `validate:"min=1"`
+	// RetryBackoff is the longest wait before the first retry. It doubles
+	// with every retry, up to MaxRetryBackoff.
+	RetryBackoff Duration
+	// MaxRetryBackoff caps the wait between retries.
+	MaxRetryBackoff Duration
+	// MaxUploadSize is the size in bytes of the largest file clients can
+	// upload. Uploads are held in memory until the file is closed, so the
+	// size is capped at 16 GiB, which is also the limit when it's zero.
+	MaxUploadSize int64 `validate:"min=0"`
+	// WorkQueueSize is the number of requests to the remote that can be
+	// queued up for the workers.
+	WorkQueueSize int `validate:"min=1"`
+	// ShutdownTimeout is how long active sessions are given to finish after
+	// SIGINT or SIGTERM, before they're closed.
+	ShutdownTimeout Duration
+}
+
+// DefaultServerConfig returns the server settings used for any that are left
+// out of the config file.
+func DefaultServerConfig() ServerConfig {
+	pool := backend.DefaultPoolOptions()
+	retry := backend.DefaultRetryPolicy()
+	return ServerConfig{
+		ListenAddr:    "0.0.0.0:9022",
+		Workers:       32,
+		PoolCapacity:  pool.Capacity,
+		WorkQueueSize: requester.DefaultWorkQueueSize,
+
+		MaxConnections:    pool.MaxConns,
+		AcquireTimeout:    Duration{pool.AcquireTimeout},
+		KeepaliveInterval: Duration{pool.KeepaliveInterval},
+		KeepaliveTimeout:  Duration{pool.KeepaliveTimeout},
+		IdleTimeout:       Duration{pool.IdleTimeout},
+
+		RetryAttempts:   retry.MaxAttempts,
+		RetryBackoff:    Duration{retry.InitialBackoff},
+		MaxRetryBackoff: Duration{retry.MaxBackoff},
+
+		MaxUploadSize: filetree.DefaultMaxFileSize,
+
+		ShutdownTimeout: Duration{30 * time.Second},
+	}
+}
+
+// PoolOptions converts the server settings to options for the pools of
+// connections to the remotes.
+func (s ServerConfig) PoolOptions() backend.PoolOptions {
+	return backend.PoolOptions{
+		Capacity:          s.PoolCapacity,
+		MaxConns:          s.MaxConnections,
+		AcquireTimeout:    s.AcquireTimeout.Duration,
+		KeepaliveInterval: s.KeepaliveInterval.Duration,
+		KeepaliveTimeout:  s.KeepaliveTimeout.Duration,
+		IdleTimeout:       s.IdleTimeout.Duration,
+	}
+}
+
+// RetryPolicy converts the server settings to the policy for retrying reads
+// from the remotes.
+func (s ServerConfig) RetryPolicy() backend.RetryPolicy {
+	return backend.RetryPolicy{
+		MaxAttempts:    s.RetryAttempts,
+		InitialBackoff: s.RetryBackoff.Duration,
+		MaxBackoff:     s.MaxRetryBackoff.Duration,
+	}
+}
+
+// Validate checks that the server settings are usable. The returned error is
+// a *ValidationError listing every invalid setting.
+func (s ServerConfig) Validate() error {
+	var p problems
+	p.addStruct("", s)
+	p.add(s.checkListenAddr("ListenAddr"))
+	return p.err()
+}
+
+// checkListenAddr checks the format of ListenAddr, which is referred to as
+// field in the returned error. An empty ListenAddr is left to the required
+// check.
+func (s ServerConfig) checkListenAddr(field string) error {
+	if s.ListenAddr == "" {
+		return nil
+	}
+	network, addr := s.Listener()
+	if network == "unix" {
+		if addr == "" {
+			return fmt.Errorf("%s %q is missing the socket path", field, s.ListenAddr)
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%s %q is not a host:port or unix socket: %s", field, s.ListenAddr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%s %q has an invalid port", field, s.ListenAddr)
+	}
+	return nil
+}
+
+// Listener returns the network and address to pass to net.Listen for
+// ListenAddr.
+func (s ServerConfig) Listener() (network, address string) {
+	if strings.HasPrefix(s.ListenAddr, unixPrefix) {
+		return "unix", strings.TrimPrefix(s.ListenAddr, unixPrefix)
+	}
+	return "tcp", s.ListenAddr
+}
@@ -0,0 +1,139 @@
+package config_test
+
+import (
+	"time"
+
+	"github.com/flawedmatrix/gocryptsftp/backend"
+	"github.com/flawedmatrix/gocryptsftp/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ServerConfig", func() {
+	var server config.ServerConfig
+
+	BeforeEach(func() {
+		server = config.DefaultServerConfig()
+	})
+
+	It("listens on port 9022 of all interfaces by default", func() {
+		network, addr := server.Listener()
+		Expect(network).To(Equal("tcp"))
+		Expect(addr).To(Equal("0.0.0.0:9022"))
+		Expect(server.Validate()).To(Succeed())
+	})
+
+	It("listens on unix sockets", func() {
+		server.ListenAddr = "unix:/run/gocryptsftp.sock"
+		network, addr := server.Listener()
+		Expect(network).To(Equal("unix"))
+		Expect(addr).To(Equal("/run/gocryptsftp.sock"))
+		Expect(server.Validate()).To(Succeed())
+	})
+
+	It("accepts TCP addresses and unix sockets", func() {
+		for _, listenAddr := range []string{
+			"127.0.0.1:9022", "localhost:9022", "[::1]:9022", ":9022",
+		} {
+			server.ListenAddr = listenAddr
+			Expect(server.Validate()).To(Succeed(), listenAddr)
+		}
+	})
+
+	It("rejects invalid listen addresses", func() {
+		for _, listenAddr := range []string{
+			"", "127.0.0.1", "127.0.0.1:http", "127.0.0.1:70000", "unix:",
+		} {
+			server.ListenAddr = listenAddr
+			Expect(server.Validate()).To(MatchError(ContainSubstring("ListenAddr")), listenAddr)
+		}
+	})
+
+	Context("when there are no workers", func() {
+		BeforeEach(func() {
+			server.Workers = 0
+		})
+
+		It("fails validation", func() {
+			Expect(server.Validate()).To(MatchError(ContainSubstring("Workers")))
+		})
+	})
+
+	Context("when the pool capacity is negative", func() {
+		BeforeEach(func() {
+			server.PoolCapacity = -1
+		})
+
+		It("fails validation", func() {
+			Expect(server.Validate()).To(MatchError(ContainSubstring("PoolCapacity")))
+		})
+	})
+
+	Context("when the maximum number of connections is negative", func() {
+		BeforeEach(func() {
+			server.MaxConnections = -1
+		})
+
+		It("fails validation", func() {
+			Expect(server.Validate()).To(MatchError(ContainSubstring("MaxConnections")))
+		})
+	})
+
+	It("converts the connection settings to pool options", func() {
+		server.PoolCapacity = 4
+		server.MaxConnections = 8
+		server.AcquireTimeout = config.Duration{Duration: time.Second}
+		server.KeepaliveInterval = config.Duration{Duration: 2 * time.Second}
+		server.KeepaliveTimeout = config.Duration{Duration: 3 * time.Second}
+		server.IdleTimeout = config.Duration{Duration: time.Minute}
+		Expect(server.PoolOptions()).To(Equal(backend.PoolOptions{
+			Capacity:          4,
+			MaxConns:          8,
+			AcquireTimeout:    time.Second,
+			KeepaliveInterval: 2 * time.Second,
+			KeepaliveTimeout:  3 * time.Second,
+			IdleTimeout:       time.Minute,
+		}))
+	})
+
+	Context("when there are no retry attempts", func() {
+		BeforeEach(func() {
+			server.RetryAttempts = 0
+		})
+
+		It("fails validation", func() {
+			Expect(server.Validate()).To(MatchError(ContainSubstring("RetryAttempts")))
+		})
+	})
+
+	It("converts the retry settings to a retry policy", func() {
+		server.RetryAttempts = 5
+		server.RetryBackoff = config.Duration{Duration: time.Second}
+		server.MaxRetryBackoff = config.Duration{Duration: time.Minute}
+		Expect(server.RetryPolicy()).To(Equal(backend.RetryPolicy{
+			MaxAttempts:    5,
+			InitialBackoff: time.Second,
+			MaxBackoff:     time.Minute,
+		}))
+	})
+
+	Context("when the maximum upload size is negative", func() {
+		BeforeEach(func() {
+			server.MaxUploadSize = -1
+		})
+
+		It("fails validation", func() {
+			Expect(server.Validate()).To(MatchError(ContainSubstring("MaxUploadSize")))
+		})
+	})
+
+	Context("when the work queue size is zero", func() {
+		BeforeEach(func() {
+			server.WorkQueueSize = 0
+		})
+
+		It("fails validation", func() {
+			Expect(server.Validate()).To(MatchError(ContainSubstring("WorkQueueSize")))
+		})
+	})
+})
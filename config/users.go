@@ -0,0 +1,105 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UserConfig is a proxy user, and the part of the served files it may
+// access.
+type UserConfig struct {
+	Name string `validate:"required"`
+	// PasswordHash is a bcrypt hash of the password the user may
+	// authenticate with.
+	PasswordHash string `validate:"required_without=AuthorizedKeysPath"`
+	// AuthorizedKeysPath is an authorized_keys file with the public keys the
+	// user may authenticate with.
+	AuthorizedKeysPath string `validate:"required_without=PasswordHash,omitempty,file"`
+	// Volume is the only volume the user may access. If it's empty, the user
+	// may access all of them.
+	Volume string
+	// Root is the directory the user is confined to, within Volume if it's
+	// set. The user sees it as the root. It defaults to "/".
+	Root string
+	// ReadOnly denies the user any changes to the files.
+	ReadOnly bool
+}
+
+// AllUsers returns the proxy users. If no Users are configured, this is the
+// single user described by ProxyUser, ProxyPasswordHash and
+// AuthorizedKeysPath, which may change everything that's served.
+func (c *Config) AllUsers() []UserConfig {
+	if len(c.Users) == 0 {
+		return []UserConfig{*c.rootUser()}
+	}
+	return c.Users
+}
+
+func (c *Config) rootUser() *UserConfig {
+	return &UserConfig{
+		Name:               c.ProxyUser,
+		PasswordHash:       c.ProxyPasswordHash,
+		AuthorizedKeysPath: c.AuthorizedKeysPath,
+	}
+}
+
+// ServedRoot returns the directory the user is confined to, as a path in
+// the files served by the proxy.
+func (u *UserConfig) ServedRoot() string {
+	return path.Join("/", u.Volume, path.Clean("/"+u.Root))
+}
+
+// rootUserFields are the fields of Config that describe the user when no
+// Users are configured.
+var rootUserFields = []string{"ProxyUser", "ProxyPasswordHash", "AuthorizedKeysPath"}
+
+// validateUsers adds the problems with the users to p. The fields describing
+// the user when no Users are configured are validated by addStruct.
+func (c *Config) validateUsers(p *problems) {
+	if len(c.Users) == 0 {
+		p.add(checkPasswordHash("ProxyPasswordHash", c.ProxyPasswordHash))
+		return
+	}
+	if *c.rootUser() != (UserConfig{}) {
+		p.add(errors.New("ProxyUser, ProxyPasswordHash and AuthorizedKeysPath can't be set together with Users"))
+	}
+	volumes := map[string]bool{}
+	for _, v := range c.Volumes {
+		volumes[v.Name] = true
+	}
+	seen := map[string]bool{}
+	for i, u := range c.Users {
+		field := fmt.Sprintf("Users[%d]", i)
+		if u.Name != "" {
+			field = fmt.Sprintf("Users[%s]", u.Name)
+		}
+		p.addStruct(field+".", u)
+		if u.Name != "" && seen[u.Name] {
+			p.add(fmt.Errorf("%s.Name is used by more than one user", field))
+		}
+		seen[u.Name] = true
+		p.add(checkPasswordHash(field+".PasswordHash", u.PasswordHash))
+		switch {
+		case u.Volume == "":
+		case len(c.Volumes) == 0:
+			p.add(fmt.Errorf("%s.Volume can only be set together with Volumes", field))
+		case !volumes[u.Volume]:
+			p.add(fmt.Errorf("%s.Volume: no volume named %q", field, u.Volume))
+		}
+	}
+}
+
+// checkPasswordHash returns an error if hash is set but isn't a bcrypt hash.
+// The hash is referred to as field in the returned error.
+func checkPasswordHash(field string, hash string) error {
+	if hash == "" {
+		return nil
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("%s is not a bcrypt hash: %s", field, err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package config_test
+
+import (
+	"errors"
+	"os"
+
+	"github.com/flawedmatrix/gocryptsftp/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ = Describe("Users", func() {
+	var cfg *config.Config
+
+	BeforeEach(func() {
+		aliceHash, err := bcrypt.GenerateFromPassword([]byte("alicepass"), bcrypt.MinCost)
+		Expect(err).NotTo(HaveOccurred())
+		cfg = &config.Config{
+			KnownHostsPath: os.Args[0],
+			Server:         config.DefaultServerConfig(),
+			Volumes: []config.VolumeConfig{
+				{Name: "photos", Remote: config.RemoteConfig{
+					Addr:           "remote.addr.com:22",
+					FileRoot:       "/photos",
+					User:           "remote-user",
+					PrivateKeyPath: os.Args[0],
+				}},
+			},
+			Users: []config.UserConfig{
+				{Name: "alice", PasswordHash: string(aliceHash)},
+				{Name: "bob", AuthorizedKeysPath: os.Args[0], Volume: "photos", Root: "/2020", ReadOnly: true},
+			},
+		}
+	})
+
+	validationProblems := func() []string {
+		var validationErr *config.ValidationError
+		ExpectWithOffset(1, errors.As(cfg.Validate(), &validationErr)).To(BeTrue())
+		return validationErr.Problems
+	}
+
+	It("successfully validates", func() {
+		Expect(cfg.Validate()).To(Succeed())
+	})
+
+	It("confines each user to its volume and root", func() {
+		users := cfg.AllUsers()
+		Expect(users[0].ServedRoot()).To(Equal("/"))
+		Expect(users[1].ServedRoot()).To(Equal("/photos/2020"))
+	})
+
+	It("doesn't let a root lead outside of the volume", func() {
+		u := config.UserConfig{Volume: "photos", Root: "../docs"}
+		Expect(u.ServedRoot()).To(Equal("/photos/docs"))
+	})
+
+	Context("when no users are configured", func() {
+		BeforeEach(func() {
+			cfg.Users = nil
+			cfg.ProxyUser = "someuser"
+			cfg.AuthorizedKeysPath = os.Args[0]
+		})
+
+		It("has the single proxy user, which may access everything", func() {
+			Expect(cfg.AllUsers()).To(Equal([]config.UserConfig{
+				{Name: "someuser", AuthorizedKeysPath: os.Args[0]},
+			}))
+			Expect(cfg.AllUsers()[0].ServedRoot()).To(Equal("/"))
+			Expect(cfg.Validate()).To(Succeed())
+		})
+	})
+
+	Context("when a user is invalid", func() {
+		BeforeEach(func() {
+			cfg.Users[0].PasswordHash = "alicepass"
+			cfg.Users[1].AuthorizedKeysPath = ""
+			cfg.Users[1].Volume = "docs"
+		})
+
+		It("reports the problems under the name of the user", func() {
+			Expect(validationProblems()).To(ConsistOf(
+				ContainSubstring("Users[alice].PasswordHash is not a bcrypt hash"),
+				"Users[bob].PasswordHash is required when AuthorizedKeysPath isn't set",
+				"Users[bob].AuthorizedKeysPath is required when PasswordHash isn't set",
+				`Users[bob].Volume: no volume named "docs"`,
+			))
+		})
+	})
+
+	Context("when two users have the same name", func() {
+		BeforeEach(func() {
+			cfg.Users[1].Name = "alice"
+		})
+
+		It("fails validation", func() {
+			Expect(validationProblems()).To(ConsistOf("Users[alice].Name is used by more than one user"))
+		})
+	})
+
+	Context("when a user has a volume but no volumes are configured", func() {
+		BeforeEach(func() {
+			cfg.Remote = cfg.Volumes[0].Remote
+			cfg.Volumes = nil
+		})
+
+		It("fails validation", func() {
+			Expect(validationProblems()).To(ConsistOf("Users[bob].Volume can only be set together with Volumes"))
+		})
+	})
+
+	Context("when the single proxy user is also configured", func() {
+		BeforeEach(func() {
+			cfg.ProxyUser = "someuser"
+		})
+
+		It("fails validation", func() {
+			Expect(validationProblems()).To(ConsistOf(
+				"ProxyUser, ProxyPasswordHash and AuthorizedKeysPath can't be set together with Users",
+			))
+		})
+	})
+
+	Describe("FindUser", func() {
+		It("returns the user with the given name", func() {
+			u, err := cfg.FindUser("bob")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.Root).To(Equal("/2020"))
+		})
+
+		It("rejects unknown users", func() {
+			_, err := cfg.FindUser("carol")
+			Expect(err).To(MatchError(config.ErrProxyAuthRejected))
+		})
+	})
+
+	Describe("CheckProxyPassword", func() {
+		It("accepts the password of the user", func() {
+			Expect(cfg.CheckProxyPassword("alice", []byte("alicepass"))).To(Succeed())
+		})
+
+		It("rejects users without a password", func() {
+			Expect(cfg.CheckProxyPassword("bob", []byte(""))).To(MatchError(config.ErrProxyAuthRejected))
+		})
+
+		It("rejects unknown users", func() {
+			Expect(cfg.CheckProxyPassword("carol", []byte("alicepass"))).To(MatchError(config.ErrProxyAuthRejected))
+		})
+	})
+})
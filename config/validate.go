@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/go-playground/validator.v9"
+)
+
+// ValidationError lists every problem found while validating a config.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// problems collects the problems found while validating a config.
+type problems []string
+
+// addStruct validates the struct s and adds a readable description of each
+// invalid field. Fields are named by their path from s, after prefix. The
+// fields in except aren't validated.
+func (p *problems) addStruct(prefix string, s interface{}, except ...string) {
+	var err error
+	if len(except) > 0 {
+		err = validator.New().StructExcept(s, except...)
+	} else {
+		err = validator.New().Struct(s)
+	}
+	fieldErrs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		if err != nil {
+			*p = append(*p, err.Error())
+		}
+		return
+	}
+	for _, fe := range fieldErrs {
+		*p = append(*p, describeFieldError(prefix, fe))
+	}
+}
+
+// add adds err as a problem, if it isn't nil.
+func (p *problems) add(err error) {
+	if err != nil {
+		*p = append(*p, err.Error())
+	}
+}
+
+// err returns the collected problems as a *ValidationError, or nil if there
+// are none.
+func (p problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: p}
+}
+
+func describeFieldError(prefix string, fe validator.FieldError) string {
+	field := fe.Namespace()
+	// Drop the name of the struct that was validated.
+	if i := strings.Index(field, "."); i >= 0 {
+		field = field[i+1:]
+	}
+	field = prefix + field
+	switch fe.Tag() {
+	case "required":
+		return fmt.Sprintf("%s is required", field)
+	case "required_without":
+		return fmt.Sprintf("%s is required when %s isn't set", field, fe.Param())
+	case "file":
+		return fmt.Sprintf("%s: no file at %q", field, fe.Value())
+	case "min":
+		return fmt.Sprintf("%s must be at least %s", field, fe.Param())
+	default:
+		return fmt.Sprintf("%s is invalid (%s)", field, fe.Tag())
+	}
+}
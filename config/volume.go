@@ -0,0 +1,75 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// VolumeConfig is a gocryptfs volume served by the proxy.
+type VolumeConfig struct {
+	// Name is the name of the top-level directory the volume is served at.
+	// It's empty for the volume served at the root when no Volumes are
+	// configured.
+	Name        string
+	Remote      RemoteConfig
+	Passphrases PassphrasesConfig
+}
+
+// remoteConnFields are the fields of RemoteConfig that are only needed to
+// connect to a remote, which a local volume doesn't.
+var remoteConnFields = []string{"Addr", "User", "PrivateKeyPath"}
+
+// AllVolumes returns the volumes to serve. If no Volumes are configured, this
+// is the single unnamed volume described by Remote and Passphrases, which is
+// served at the root.
+func (c *Config) AllVolumes() []VolumeConfig {
+	if len(c.Volumes) == 0 {
+		return []VolumeConfig{*c.rootVolume()}
+	}
+	return c.Volumes
+}
+
+func (c *Config) rootVolume() *VolumeConfig {
+	return &VolumeConfig{Remote: c.Remote, Passphrases: c.Passphrases}
+}
+
+// validateVolumes adds the problems with the volumes to p.
+func (c *Config) validateVolumes(p *problems) {
+	if len(c.Volumes) == 0 {
+		c.rootVolume().validate(p, "")
+		return
+	}
+	if !reflect.DeepEqual(*c.rootVolume(), VolumeConfig{}) {
+		p.add(fmt.Errorf("Remote and Passphrases can't be set together with Volumes"))
+	}
+	seen := map[string]bool{}
+	for i, v := range c.Volumes {
+		field := fmt.Sprintf("Volumes[%d]", i)
+		if v.Name != "" {
+			field = fmt.Sprintf("Volumes[%s]", v.Name)
+		}
+		switch {
+		case v.Name == "":
+			p.add(fmt.Errorf("%s.Name is required", field))
+		case v.Name == "." || v.Name == ".." || strings.Contains(v.Name, "/"):
+			p.add(fmt.Errorf("%s.Name must be a valid directory name", field))
+		case seen[v.Name]:
+			p.add(fmt.Errorf("%s.Name is used by more than one volume", field))
+		}
+		seen[v.Name] = true
+		v.validate(p, field+".")
+	}
+}
+
+// validate adds the problems with the volume to p, naming its fields after
+// prefix.
+func (v VolumeConfig) validate(p *problems, prefix string) {
+	if v.Remote.Local {
+		p.addStruct(prefix+"Remote.", v.Remote, remoteConnFields...)
+	} else {
+		p.addStruct(prefix+"Remote.", v.Remote)
+	}
+	p.add(v.Passphrases.PrivateKey.validate(prefix + "Passphrases.PrivateKey"))
+	p.add(v.Passphrases.Decryption.validate(prefix + "Passphrases.Decryption"))
+}
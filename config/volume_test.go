@@ -0,0 +1,139 @@
+package config_test
+
+import (
+	"errors"
+	"os"
+
+	"github.com/flawedmatrix/gocryptsftp/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Volumes", func() {
+	var cfg *config.Config
+
+	remote := func(fileRoot string) config.RemoteConfig {
+		return config.RemoteConfig{
+			Addr:           "remote.addr.com:22",
+			FileRoot:       fileRoot,
+			User:           "remote-user",
+			PrivateKeyPath: os.Args[0],
+		}
+	}
+
+	BeforeEach(func() {
+		cfg = &config.Config{
+			ProxyUser:         "someuser",
+			ProxyPasswordHash: "$2a$04$flHPmYtM6LKZP.O0TBEl2uZKzR5s76JxGI/Cp7ObBvx3biO2wV8yC",
+			KnownHostsPath:    os.Args[0],
+			Server:            config.DefaultServerConfig(),
+			Volumes: []config.VolumeConfig{
+				{Name: "photos", Remote: remote("/photos")},
+				{Name: "docs", Remote: remote("/docs")},
+			},
+		}
+	})
+
+	validationProblems := func() []string {
+		var validationErr *config.ValidationError
+		ExpectWithOffset(1, errors.As(cfg.Validate(), &validationErr)).To(BeTrue())
+		return validationErr.Problems
+	}
+
+	It("successfully validates", func() {
+		Expect(cfg.Validate()).To(Succeed())
+	})
+
+	It("serves the configured volumes", func() {
+		Expect(cfg.AllVolumes()).To(Equal(cfg.Volumes))
+	})
+
+	Context("when no volumes are configured", func() {
+		BeforeEach(func() {
+			cfg.Volumes = nil
+			cfg.Remote = remote("/root")
+			cfg.Passphrases.Decryption.Env = "PASS"
+		})
+
+		It("serves the remote as a single unnamed volume", func() {
+			Expect(cfg.AllVolumes()).To(Equal([]config.VolumeConfig{
+				{Remote: cfg.Remote, Passphrases: cfg.Passphrases},
+			}))
+			Expect(cfg.Validate()).To(Succeed())
+		})
+	})
+
+	Context("when a volume is invalid", func() {
+		BeforeEach(func() {
+			cfg.Volumes[1].Remote.FileRoot = ""
+			cfg.Volumes[1].Passphrases.Decryption.Env = "PASS"
+			cfg.Volumes[1].Passphrases.Decryption.File = "/pass"
+		})
+
+		It("reports the problems under the name of the volume", func() {
+			Expect(validationProblems()).To(ConsistOf(
+				"Volumes[docs].Remote.FileRoot is required",
+				"Volumes[docs].Passphrases.Decryption must only set one of File, FD, Env and Command",
+			))
+		})
+	})
+
+	Context("when a volume is local", func() {
+		BeforeEach(func() {
+			cfg.Volumes[1].Remote = config.RemoteConfig{Local: true, FileRoot: "/mnt/nas/docs"}
+		})
+
+		It("doesn't need to know how to connect to a remote", func() {
+			Expect(cfg.Validate()).To(Succeed())
+		})
+
+		It("still requires the file root", func() {
+			cfg.Volumes[1].Remote.FileRoot = ""
+			Expect(validationProblems()).To(ConsistOf("Volumes[docs].Remote.FileRoot is required"))
+		})
+	})
+
+	Context("when a volume has no name", func() {
+		BeforeEach(func() {
+			cfg.Volumes[1].Name = ""
+		})
+
+		It("fails validation", func() {
+			Expect(validationProblems()).To(ConsistOf("Volumes[1].Name is required"))
+		})
+	})
+
+	Context("when a name isn't a valid directory name", func() {
+		BeforeEach(func() {
+			cfg.Volumes[0].Name = "photos/2020"
+			cfg.Volumes[1].Name = ".."
+		})
+
+		It("fails validation", func() {
+			Expect(validationProblems()).To(ConsistOf(
+				"Volumes[photos/2020].Name must be a valid directory name",
+				"Volumes[..].Name must be a valid directory name",
+			))
+		})
+	})
+
+	Context("when two volumes have the same name", func() {
+		BeforeEach(func() {
+			cfg.Volumes[1].Name = "photos"
+		})
+
+		It("fails validation", func() {
+			Expect(validationProblems()).To(ConsistOf("Volumes[photos].Name is used by more than one volume"))
+		})
+	})
+
+	Context("when a remote is also configured outside of the volumes", func() {
+		BeforeEach(func() {
+			cfg.Remote = remote("/root")
+		})
+
+		It("fails validation", func() {
+			Expect(validationProblems()).To(ConsistOf("Remote and Passphrases can't be set together with Volumes"))
+		})
+	})
+})
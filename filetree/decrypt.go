@@ -1,15 +1,24 @@
 package filetree
 
 import (
+	"errors"
 	"io"
+	"os"
+	"sync"
 
 	"github.com/flawedmatrix/gocryptsftp/gocrypt/contentenc"
 )
 
+// readAheadSize is the amount of plaintext fetched and decrypted at once when
+// reading a file, so that small sequential reads don't each require a round
+// trip to the backend. It's small enough for the decrypted blocks to fit in a
+// single buffer from the ContentEnc pool.
+const readAheadSize = contentenc.MAX_KERNEL_WRITE
+
 // readFileID parses the file ID from the header. It returns an error
-// if there is an error parsing or if the file is practically empty.
+// if there is an error parsing or if the header is incomplete.
 func (f *FileTree) readFileID(fileBytes []byte) ([]byte, error) {
-	if len(fileBytes) <= contentenc.HeaderLen {
+	if len(fileBytes) < contentenc.HeaderLen {
 		return nil, io.EOF
 	}
 	buf := fileBytes[:contentenc.HeaderLen]
@@ -20,23 +29,125 @@ func (f *FileTree) readFileID(fileBytes []byte) ([]byte, error) {
 	return h.ID, nil
 }
 
-func (f *FileTree) decryptFile(fileBytes []byte) ([]byte, error) {
-	plainLength := f.cEnc.CipherSizeToPlainSize(uint64(len(fileBytes)))
-	fileID, err := f.readFileID(fileBytes)
+// fileReader is an io.ReaderAt over the plaintext of the file at cipherPath.
+// It keeps the most recently decrypted range of the file around, since
+// clients tend to read files sequentially in small chunks.
+type fileReader struct {
+	f          *FileTree
+	cipherPath string
+	plainSize  uint64
+	fileID     []byte
+	// file is the ciphertext file, which is kept open on the backend so that
+	// reading further ranges doesn't need to open it again. Empty files
+	// aren't opened.
+	file File
+
+	lock      sync.Mutex
+	window    []byte
+	windowOff uint64
+}
+
+// newFileReader returns a fileReader for the file at cipherPath, which is
+// cipherSize bytes large.
+func (f *FileTree) newFileReader(cipherPath string, cipherSize uint64) (*fileReader, error) {
+	r := &fileReader{
+		f:          f,
+		cipherPath: cipherPath,
+		plainSize:  f.cEnc.CipherSizeToPlainSize(cipherSize),
+	}
+	// Empty files don't have a header.
+	if r.plainSize == 0 {
+		return r, nil
+	}
+	file, err := f.fsAccessor.Open(cipherPath)
 	if err != nil {
 		return nil, err
 	}
-	blocks := f.cEnc.ExplodePlainRange(0, plainLength)
-	alignedOffset, _ := blocks[0].JointCiphertextRange(blocks)
-	plaintext, err := f.cEnc.DecryptBlocks(fileBytes[alignedOffset:], blocks[0].BlockNo, fileID)
+	header := make([]byte, contentenc.HeaderLen)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+	r.fileID, err = f.readFileID(header[:n])
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
-	if cap(plaintext) > (contentenc.MAX_KERNEL_WRITE + contentenc.DefaultBS) {
-		return plaintext, nil
+	r.file = file
+	return r, nil
+}
+
+// Close closes the ciphertext file on the backend.
+func (r *fileReader) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// ReadAt reads len(p) bytes of plaintext starting at offset off.
+func (r *fileReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("fileReader.ReadAt: negative offset")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	n := 0
+	for n < len(p) {
+		pos := uint64(off) + uint64(n)
+		if pos >= r.plainSize {
+			return n, io.EOF
+		}
+		if !r.inWindow(pos) {
+			if err := r.fill(pos); err != nil {
+				return n, err
+			}
+			// The file is shorter than its size said it was.
+			if !r.inWindow(pos) {
+				return n, io.EOF
+			}
+		}
+		n += copy(p[n:], r.window[pos-r.windowOff:])
+	}
+	return n, nil
+}
+
+func (r *fileReader) inWindow(pos uint64) bool {
+	return pos >= r.windowOff && pos < r.windowOff+uint64(len(r.window))
+}
+
+// fill fetches and decrypts up to readAheadSize bytes of plaintext, starting
+// at the beginning of the block containing pos.
+func (r *fileReader) fill(pos uint64) error {
+	if r.file == nil {
+		return os.ErrClosed
+	}
+	cEnc := r.f.cEnc
+	start := cEnc.BlockNoToPlainOff(cEnc.PlainOffToBlockNo(pos))
+	blocks := cEnc.ExplodePlainRange(start, contentenc.MinUint64(readAheadSize, r.plainSize-start))
+	alignedOffset, alignedLength := blocks[0].JointCiphertextRange(blocks)
+
+	ciphertext := cEnc.CReqPool.Get()[:alignedLength]
+	defer cEnc.CReqPool.Put(ciphertext)
+	n, err := r.file.ReadAt(ciphertext, int64(alignedOffset))
+	// The last block is usually partial, so reaching the end of the file
+	// is expected.
+	if err != nil && err != io.EOF {
+		return err
+	}
+	plaintext, err := cEnc.DecryptBlocks(ciphertext[:n], blocks[0].BlockNo, r.fileID)
+	if err != nil {
+		cEnc.PReqPool.Put(plaintext)
+		return err
 	}
-	plainBytes := make([]byte, plainLength)
-	copy(plainBytes, plaintext)
-	f.cEnc.PReqPool.Put(plaintext)
-	return plainBytes, nil
+	r.window = append(r.window[:0], plaintext...)
+	r.windowOff = start
+	cEnc.PReqPool.Put(plaintext)
+	return nil
 }
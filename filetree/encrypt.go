@@ -0,0 +1,43 @@
+package filetree
+
+import (
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/contentenc"
+)
+
+// encryptFile encrypts the plaintext into the gocryptfs on-disk format: a
+// file header with a random file ID, followed by the encrypted blocks. Empty
+// files stay empty and don't get a header, just like in gocryptfs.
+func (f *FileTree) encryptFile(plainBytes []byte) []byte {
+	if len(plainBytes) == 0 {
+		return []byte{}
+	}
+	header := contentenc.RandomHeader()
+	cipherSize := f.cEnc.PlainSizeToCipherSize(uint64(len(plainBytes)))
+	cipherBytes := make([]byte, 0, cipherSize)
+	cipherBytes = append(cipherBytes, header.Pack()...)
+
+	plainBS := int(f.cEnc.PlainBS())
+	var blocks [][]byte
+	for off := 0; off < len(plainBytes); off += plainBS {
+		end := off + plainBS
+		if end > len(plainBytes) {
+			end = len(plainBytes)
+		}
+		blocks = append(blocks, plainBytes[off:end])
+	}
+
+	// EncryptBlocks returns a buffer from CReqPool, which only fits
+	// MAX_KERNEL_WRITE bytes worth of plaintext blocks, so the blocks are
+	// encrypted in chunks of that size.
+	chunkLen := contentenc.MAX_KERNEL_WRITE / plainBS
+	for first := 0; first < len(blocks); first += chunkLen {
+		last := first + chunkLen
+		if last > len(blocks) {
+			last = len(blocks)
+		}
+		ciphertext := f.cEnc.EncryptBlocks(blocks[first:last], uint64(first), header.ID)
+		cipherBytes = append(cipherBytes, ciphertext...)
+		f.cEnc.CReqPool.Put(ciphertext)
+	}
+	return cipherBytes
+}
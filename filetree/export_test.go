@@ -0,0 +1,9 @@
+package filetree
+
+// DirStates returns the number of directories whose state on the backend is
+// being kept track of.
+func (f *FileTree) DirStates() int {
+	f.dirStates.lock.Lock()
+	defer f.dirStates.lock.Unlock()
+	return len(f.dirStates.states)
+}
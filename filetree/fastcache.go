@@ -1,6 +1,7 @@
 package filetree
 
 import (
+	"strings"
 	"sync"
 )
 
@@ -55,6 +56,7 @@ func (f *FastCache) refreshNode(d *DirMapping) {
 		} else {
 			f.head = d.next
 		}
+		d.next.prev = d.prev
 		d.prev = f.last
 		d.next = nil
 		f.last.next = d
@@ -118,3 +120,84 @@ func (f *FastCache) Store(pPath, cPath string) {
 		}
 	}
 }
+
+// Move updates the mappings for the plaintext directory oldPPath and every
+// directory under it after the directory was moved to newPPath. oldCPath and
+// newCPath are the ciphertext paths of the directory before and after the
+// move. Any mappings previously stored under newPPath are dropped.
+func (f *FastCache) Move(oldPPath, oldCPath, newPPath, newCPath string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var moved []*DirMapping
+	for pPath, d := range f.storage {
+		if isUnder(pPath, oldPPath) {
+			moved = append(moved, d)
+		} else if isUnder(pPath, newPPath) {
+			f.unlink(d)
+		}
+	}
+	for _, d := range moved {
+		delete(f.storage, d.PlaintextPath)
+	}
+	for _, d := range moved {
+		d.PlaintextPath = newPPath + strings.TrimPrefix(d.PlaintextPath, oldPPath)
+		if isUnder(d.CiphertextPath, oldCPath) {
+			d.CiphertextPath = newCPath + strings.TrimPrefix(d.CiphertextPath, oldCPath)
+		}
+		f.storage[d.PlaintextPath] = d
+	}
+}
+
+// Delete removes the mappings for the plaintext directory pPath and every
+// directory under it.
+func (f *FastCache) Delete(pPath string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for p, d := range f.storage {
+		if isUnder(p, pPath) {
+			f.unlink(d)
+		}
+	}
+}
+
+// DeleteCiphertext removes the mappings for the directory whose ciphertext
+// path is cPath and for every directory under it.
+func (f *FastCache) DeleteCiphertext(cPath string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, d := range f.storage {
+		if isUnder(d.CiphertextPath, cPath) {
+			f.unlink(d)
+		}
+	}
+}
+
+// unlink removes the node from the linked hash map
+func (f *FastCache) unlink(d *DirMapping) {
+	if d.prev != nil {
+		d.prev.next = d.next
+	} else {
+		f.head = d.next
+	}
+	if d.next != nil {
+		d.next.prev = d.prev
+	} else {
+		f.last = d.prev
+	}
+	d.prev = nil
+	d.next = nil
+	delete(f.storage, d.PlaintextPath)
+	f.count--
+}
+
+// isUnder returns true if path is dir itself or is located somewhere under
+// dir.
+func isUnder(path, dir string) bool {
+	if dir == "/" {
+		return strings.HasPrefix(path, "/")
+	}
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
@@ -104,4 +104,116 @@ var _ = Describe("FastCache", func() {
 			expectMappingFound("baq456", "baz123")
 		}
 	})
+
+	It("keeps track of the least recently used item across many lookups", func() {
+		f.Store("foo123", "bar123")
+		f.Store("baz123", "baq456")
+		f.Store("bar123", "foo123")
+
+		expectMappingFound("foo123", "bar123")
+		expectMappingFound("baz123", "baq456")
+		expectMappingFound("foo123", "bar123")
+
+		// bar123 is the least recently used now
+		f.Store("baq456", "baz123")
+
+		_, found := f.Find("bar123")
+		Expect(found).To(BeFalse())
+		expectMappingFound("foo123", "bar123")
+		expectMappingFound("baz123", "baq456")
+		expectMappingFound("baq456", "baz123")
+	})
+
+	Describe("Move", func() {
+		BeforeEach(func() {
+			f = filetree.NewFastCache(5)
+			f.Store("/a", "/enc/A")
+			f.Store("/a/b", "/enc/A/B")
+			f.Store("/ab", "/enc/AB")
+			f.Store("/c", "/enc/C")
+		})
+
+		It("moves the directory and everything under it", func() {
+			f.Move("/a", "/enc/A", "/c/a2", "/enc/C/A2")
+
+			expectMappingFound("/c/a2", "/enc/C/A2")
+			expectMappingFound("/c/a2/b", "/enc/C/A2/B")
+			_, found := f.Find("/a")
+			Expect(found).To(BeFalse())
+			_, found = f.Find("/a/b")
+			Expect(found).To(BeFalse())
+		})
+
+		It("leaves directories with similar names alone", func() {
+			f.Move("/a", "/enc/A", "/c/a2", "/enc/C/A2")
+
+			expectMappingFound("/ab", "/enc/AB")
+			expectMappingFound("/c", "/enc/C")
+		})
+
+		It("drops mappings previously stored at the target", func() {
+			f.Store("/d", "/enc/D-old")
+			f.Move("/a/b", "/enc/A/B", "/d", "/enc/D")
+
+			expectMappingFound("/d", "/enc/D")
+
+			// With the stale entry gone, there's room for one more entry
+			// without evicting anything.
+			f.Store("/e", "/enc/E")
+			expectMappingFound("/a", "/enc/A")
+			expectMappingFound("/ab", "/enc/AB")
+			expectMappingFound("/c", "/enc/C")
+			expectMappingFound("/d", "/enc/D")
+			expectMappingFound("/e", "/enc/E")
+		})
+	})
+
+	Describe("Delete", func() {
+		BeforeEach(func() {
+			f = filetree.NewFastCache(5)
+			f.Store("/a", "/enc/A")
+			f.Store("/a/b", "/enc/A/B")
+			f.Store("/ab", "/enc/AB")
+		})
+
+		It("deletes the directory and everything under it", func() {
+			f.Delete("/a")
+
+			_, found := f.Find("/a")
+			Expect(found).To(BeFalse())
+			_, found = f.Find("/a/b")
+			Expect(found).To(BeFalse())
+			expectMappingFound("/ab", "/enc/AB")
+		})
+
+		It("frees up room for new entries", func() {
+			f.Delete("/a")
+			f.Store("/c", "/enc/C")
+			f.Store("/d", "/enc/D")
+			f.Store("/e", "/enc/E")
+			f.Store("/f", "/enc/F")
+
+			expectMappingFound("/ab", "/enc/AB")
+			expectMappingFound("/f", "/enc/F")
+		})
+	})
+
+	Describe("DeleteCiphertext", func() {
+		BeforeEach(func() {
+			f = filetree.NewFastCache(5)
+			f.Store("/a", "/enc/A")
+			f.Store("/a/b", "/enc/A/B")
+			f.Store("/ab", "/enc/AB")
+		})
+
+		It("deletes the directory with the ciphertext path and everything under it", func() {
+			f.DeleteCiphertext("/enc/A")
+
+			_, found := f.Find("/a")
+			Expect(found).To(BeFalse())
+			_, found = f.Find("/a/b")
+			Expect(found).To(BeFalse())
+			expectMappingFound("/ab", "/enc/AB")
+		})
+	})
 })
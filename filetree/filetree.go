@@ -3,9 +3,12 @@ package filetree
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/flawedmatrix/gocryptsftp/gocrypt/configfile"
 	"github.com/flawedmatrix/gocryptsftp/gocrypt/contentenc"
@@ -16,19 +19,35 @@ import (
 
 const cacheSize = 16
 
+// longNameMax is the maximum size of the contents of a long name file. The
+// longest encrypted name (255 bytes padded to 256) takes 344 bytes in base64.
+const longNameMax = 344
+
 //go:generate go run github.com/maxbrunsfeld/counterfeiter/v6 os.FileInfo
 
+//go:generate go run github.com/maxbrunsfeld/counterfeiter/v6 . FSAccessor
+
 // FSAccessor defines an accessor to the real underlying filesystem
 type FSAccessor interface {
 	ReadFile(path string) ([]byte, error)
+	// Open opens the file at path for reading parts of it. The file stays
+	// open until it's closed.
+	Open(path string) (File, error)
 	Stat(path string) (os.FileInfo, error)
 	ReadDir(path string) ([]os.FileInfo, error)
 
-	// WriteFile(path string, data []byte) (int64, error)
-	// Mkdir(path string) error
+	WriteFile(path string, data []byte) (int64, error)
+	Mkdir(path string) error
+	// Rename renames path to target, replacing target if it already exists.
+	Rename(path string, target string) error
+	// Remove removes the file or empty directory at path.
+	Remove(path string) error
+}
 
-	// Rename(path string, target string) error
-	// Remove(path string) error
+// File is a file opened with FSAccessor.Open.
+type File interface {
+	io.ReaderAt
+	io.Closer
 }
 
 // FileTree provides a plaintext view of the filesystem provided by
@@ -45,13 +64,56 @@ type FileTree struct {
 	cCore      *cryptocore.CryptoCore
 	cEnc       *contentenc.ContentEnc
 	nTransform *nametransform.NameTransform
+
+	// plaintextNames is set for filesystems that only encrypt file
+	// contents. Names are used as-is and directories have no directory IV.
+	plaintextNames bool
+
+	revalidateInterval time.Duration
+	dirStates          dirStates
+
+	maxFileSize int64
+}
+
+// Options holds the tunables of a FileTree.
+type Options struct {
+	// Cache bounds the caches and the work queue used for requests to the
+	// FSAccessor.
+	Cache requester.Limits
+	// RevalidateInterval is how often a directory is checked for changes
+	// made by other clients of the backend, by comparing its mtime and size.
+	// Files are also checked again when they're opened. A zero interval turns
+	// off the checks.
+	RevalidateInterval time.Duration
+	// MaxFileSize is the size in bytes of the largest file clients can
+	// write. Files are held in memory until they're uploaded. Zero means
+	// MaxFileSizeLimit.
+	MaxFileSize int64
 }
 
+// DefaultOptions returns the Options used when nothing else is configured.
+func DefaultOptions() Options {
+	return Options{
+		Cache:              requester.DefaultLimits(),
+		RevalidateInterval: 30 * time.Second,
+		MaxFileSize:        DefaultMaxFileSize,
+	}
+}
+
+// DefaultMaxFileSize is the default size of the largest file clients can
+// write.
+const DefaultMaxFileSize = 1 << 30
+
+// MaxFileSizeLimit caps MaxFileSize, and is the limit used when MaxFileSize
+// is zero. Files are written from memory, so there has to be some limit.
+const MaxFileSizeLimit = 16 << 30
+
 func Init(
 	encryptedRoot string,
 	password []byte,
 	numWorkers int,
 	fsAccessor FSAccessor,
+	opts Options,
 ) (*FileTree, error) {
 	confPath := filepath.Join(encryptedRoot, "gocryptfs.conf")
 	confBytes, err := fsAccessor.ReadFile(confPath)
@@ -74,17 +136,26 @@ func Init(
 		return nil, err
 	}
 	cryptoBackend := cryptocore.BackendGoGCM
+	if conf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		cryptoBackend = cryptocore.BackendAESSIV
+	}
 
 	hkdf := conf.IsFeatureFlagSet(configfile.FlagHKDF)
 	forceDecode := false
 	longNames := conf.IsFeatureFlagSet(configfile.FlagLongNames)
 	raw64 := conf.IsFeatureFlagSet(configfile.FlagRaw64)
+	plaintextNames := conf.IsFeatureFlagSet(configfile.FlagPlaintextNames)
 	cCore := cryptocore.New(
 		masterKey, cryptoBackend, contentenc.DefaultIVBits,
 		hkdf, forceDecode,
 	)
 	cEnc := contentenc.New(cCore, contentenc.DefaultBS, forceDecode)
-	nameTransform := nametransform.New(cCore.EMECipher, longNames, raw64)
+	var nameTransform *nametransform.NameTransform
+	var decrypter requester.Decrypter
+	if !plaintextNames {
+		nameTransform = nametransform.New(cCore.EMECipher, longNames, raw64)
+		decrypter = nameTransform
+	}
 
 	// After the crypto backend is initialized,
 	// we can purge the master key from memory.
@@ -94,7 +165,7 @@ func Init(
 
 	masterKey = nil
 
-	reqCacher := requester.New(numWorkers, fsAccessor, nameTransform)
+	reqCacher := requester.NewWithLimits(numWorkers, fsAccessor, decrypter, opts.Cache)
 	reqCacher.Start()
 	return &FileTree{
 		encryptedRoot: encryptedRoot,
@@ -106,18 +177,93 @@ func Init(
 		cEnc:       cEnc,
 		nTransform: nameTransform,
 
+		plaintextNames: plaintextNames,
+
+		revalidateInterval: opts.RevalidateInterval,
+		dirStates:          dirStates{states: map[string]dirState{}},
+
+		maxFileSize: opts.MaxFileSize,
+
 		fsAccessor: fsAccessor,
 		reqCacher:  reqCacher,
 	}, nil
 }
 
+// MaxFileSize returns the size in bytes of the largest file clients can
+// write.
+func (f *FileTree) MaxFileSize() int64 {
+	if f.maxFileSize <= 0 || f.maxFileSize > MaxFileSizeLimit {
+		return MaxFileSizeLimit
+	}
+	return f.maxFileSize
+}
+
+// Close stops the workers making requests to the backend, and wipes the keys
+// from memory. The FileTree must not be used afterwards.
+func (f *FileTree) Close() {
+	f.reqCacher.Stop()
+	f.cCore.Wipe()
+}
+
+// ReadFile reads and decrypts the whole file at plainPath.
 func (f *FileTree) ReadFile(plainPath string) ([]byte, error) {
-	readFileErr := func(msg string) ([]byte, error) {
-		return nil, fmt.Errorf("ReadFile: %s", msg)
+	r, err := f.openFile(plainPath)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile: %w", err)
+	}
+	defer r.Close()
+	plainBytes := make([]byte, r.plainSize)
+	n, err := r.ReadAt(plainBytes, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("ReadFile: %w", err)
+	}
+	return plainBytes[:n], nil
+}
+
+// Open returns a reader for the file at plainPath. Only the ciphertext blocks
+// covering the ranges that are read get fetched from the backend and
+// decrypted. The file is kept open on the backend until the reader is closed.
+func (f *FileTree) Open(plainPath string) (File, error) {
+	r, err := f.openFile(plainPath)
+	if err != nil {
+		return nil, fmt.Errorf("Open: %w", err)
+	}
+	return r, nil
+}
+
+func (f *FileTree) openFile(plainPath string) (*fileReader, error) {
+	ciphertextPath, item, err := f.resolve(plainPath)
+	if err != nil {
+		return nil, err
+	}
+	if item.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", ciphertextPath)
+	}
+	if f.revalidateInterval > 0 {
+		// Other clients may have changed the file without changing its
+		// directory, so the size from the cached listing can't be trusted.
+		item, err = f.fsAccessor.Stat(ciphertextPath)
+		if err != nil {
+			return nil, fmt.Errorf("error running stat on %s: %w", ciphertextPath, err)
+		}
+	}
+	r, err := f.newFileReader(ciphertextPath, uint64(item.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("error opening file %s: %w", ciphertextPath, err)
+	}
+	return r, nil
+}
+
+// WriteFile encrypts data and writes it to the file at plainPath, replacing
+// the file if it already exists. It returns the number of plaintext bytes
+// written.
+func (f *FileTree) WriteFile(plainPath string, data []byte) (int64, error) {
+	writeFileErr := func(msg string) (int64, error) {
+		return 0, fmt.Errorf("WriteFile: %s", msg)
 	}
 	cleanPath := filepath.Clean(plainPath)
 	if cleanPath == "/" {
-		return readFileErr("/ is a directory")
+		return writeFileErr("/ is a directory")
 	}
 
 	plainDirPath := filepath.Dir(cleanPath)
@@ -125,31 +271,59 @@ func (f *FileTree) ReadFile(plainPath string) ([]byte, error) {
 
 	cipherDirPath, err := f.findPath(plainDirPath)
 	if err != nil {
-		return readFileErr(fmt.Sprintf("error finding parent path: %s", err))
+		return 0, fmt.Errorf("WriteFile: error finding parent path: %w", err)
 	}
 
 	item, err := f.findInDir(cipherDirPath, plainFileName)
-	if err != nil {
-		return readFileErr(err.Error())
+	exists := err == nil
+	if exists && item.IsDir() {
+		return writeFileErr(fmt.Sprintf("%s is a directory", cleanPath))
+	} else if !exists && !errors.Is(err, os.ErrNotExist) {
+		return writeFileErr(err.Error())
 	}
-	ciphertextPath := filepath.Join(cipherDirPath, item.Name())
-	if item.IsDir() {
-		return readFileErr(fmt.Sprintf("%s is a directory", ciphertextPath))
+
+	iv, err := f.dirIV(cipherDirPath)
+	if err != nil {
+		return writeFileErr(err.Error())
 	}
-	fileBytes, err := f.reqCacher.ReadFile(ciphertextPath)
+	cipherName, err := f.encryptName(cipherDirPath, plainFileName, iv)
 	if err != nil {
-		return readFileErr(fmt.Sprintf("error reading file %s: %s", ciphertextPath, err))
+		return writeFileErr(fmt.Sprintf("error encrypting name %s: %s", plainFileName, err))
+	}
+	ciphertextPath := filepath.Join(cipherDirPath, cipherName)
+	if !exists {
+		if err = f.writeLongName(ciphertextPath, plainFileName, iv); err != nil {
+			return writeFileErr(err.Error())
+		}
 	}
 
-	plainFileBytes, err := f.decryptFile(fileBytes)
+	// The file is written under a temporary name and then renamed over the
+	// old one, so that a failed upload never leaves a truncated file behind.
+	tmpPath := filepath.Join(cipherDirPath, tempName())
+	_, err = f.fsAccessor.WriteFile(tmpPath, f.encryptFile(data))
+	if err == nil {
+		err = f.fsAccessor.Rename(tmpPath, ciphertextPath)
+	}
 	if err != nil {
-		return readFileErr(fmt.Sprintf("error decrypting file %s: %s", ciphertextPath, err))
+		_ = f.fsAccessor.Remove(tmpPath)
 	}
-	return plainFileBytes, nil
+	// Whether or not the write succeeded, what's cached about the file and
+	// its directory can't be trusted anymore.
+	f.reqCacher.ClearFile(ciphertextPath)
+	f.reqCacher.ClearDir(cipherDirPath)
+	if err != nil {
+		if !exists {
+			_ = f.removeLongName(ciphertextPath)
+		}
+		return writeFileErr(fmt.Sprintf("error writing file %s: %s", ciphertextPath, err))
+	}
+	return int64(len(data)), nil
 }
 
-func (f *FileTree) WriteFile(plainPath string, data []byte) (int64, error) {
-	return 0, errors.New("Not supported yet")
+// tempName returns a random name for a file that is being uploaded. It
+// isn't a valid encrypted name, so it's left out of directory listings.
+func tempName() string {
+	return fmt.Sprintf("gocryptsftp.tmp.%x", cryptocore.RandBytes(8))
 }
 
 func (f *FileTree) ReadDir(plainPath string) ([]os.FileInfo, error) {
@@ -159,17 +333,12 @@ func (f *FileTree) ReadDir(plainPath string) ([]os.FileInfo, error) {
 	cleanPath := filepath.Clean(plainPath)
 	ciphertextPath, err := f.findPath(cleanPath)
 	if err != nil {
-		return readDirErr(fmt.Sprintf("error finding path %s: %s", cleanPath, err))
+		return nil, fmt.Errorf("ReadDir: error finding path %s: %w", cleanPath, err)
 	}
 	var listing []os.FileInfo
 
 	err = f.rangeInDir(ciphertextPath, func(info os.FileInfo, plainName string) bool {
-		newInfo := plainFileInfo{
-			FileInfo: info,
-			name:     plainName,
-			size:     int64(f.cEnc.CipherSizeToPlainSize(uint64(info.Size()))),
-		}
-		listing = append(listing, newInfo)
+		listing = append(listing, f.plainInfo(info, plainName))
 		return false
 	})
 	if err != nil {
@@ -178,38 +347,268 @@ func (f *FileTree) ReadDir(plainPath string) ([]os.FileInfo, error) {
 	return listing, nil
 }
 
+// Stat returns the file info of the file or directory at plainPath. Apart
+// from the root, the file info comes from the listing of the parent
+// directory, so it's usually answered from the cache.
 func (f *FileTree) Stat(plainPath string) (os.FileInfo, error) {
-	statErr := func(msg string) (os.FileInfo, error) {
-		return nil, fmt.Errorf("Stat: %s", msg)
+	cleanPath := filepath.Clean(plainPath)
+	_, item, err := f.resolve(cleanPath)
+	if err != nil {
+		return nil, fmt.Errorf("Stat: %w", err)
+	}
+	return f.plainInfo(item, filepath.Base(cleanPath)), nil
+}
+
+// Mkdir creates the directory at plainPath, along with a gocryptfs.diriv
+// holding a new random IV for the directory.
+func (f *FileTree) Mkdir(plainPath string) error {
+	mkdirErr := func(msg string) error {
+		return fmt.Errorf("Mkdir: %s", msg)
 	}
 	cleanPath := filepath.Clean(plainPath)
+	if cleanPath == "/" {
+		return mkdirErr("/ already exists")
+	}
 
-	plainBaseName := filepath.Base(cleanPath)
-	cipherPath, err := f.findPath(cleanPath)
+	plainParentPath := filepath.Dir(cleanPath)
+	plainDirName := filepath.Base(cleanPath)
+
+	cipherParentPath, err := f.findPath(plainParentPath)
 	if err != nil {
-		return statErr(fmt.Sprintf("error finding path: %s", err))
+		return fmt.Errorf("Mkdir: error finding parent path: %w", err)
+	}
+
+	_, err = f.findInDir(cipherParentPath, plainDirName)
+	if err == nil {
+		return fmt.Errorf("Mkdir: %s: %w", cleanPath, os.ErrExist)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return mkdirErr(err.Error())
 	}
-	item, err := f.fsAccessor.Stat(cipherPath)
+
+	iv, err := f.dirIV(cipherParentPath)
 	if err != nil {
-		return statErr(fmt.Sprintf("error running stat on path: %s", err))
+		return mkdirErr(err.Error())
+	}
+	cipherName, err := f.encryptName(cipherParentPath, plainDirName, iv)
+	if err != nil {
+		return mkdirErr(fmt.Sprintf("error encrypting name %s: %s", plainDirName, err))
+	}
+	ciphertextPath := filepath.Join(cipherParentPath, cipherName)
+	if err = f.writeLongName(ciphertextPath, plainDirName, iv); err != nil {
+		return mkdirErr(err.Error())
 	}
-	return plainFileInfo{
-		FileInfo: item,
-		name:     plainBaseName,
-		size:     int64(f.cEnc.CipherSizeToPlainSize(uint64(item.Size()))),
-	}, nil
-}
 
-func (f *FileTree) Mkdir(plainPath string) error {
+	err = f.fsAccessor.Mkdir(ciphertextPath)
+	f.reqCacher.ClearDir(cipherParentPath)
+	if err != nil {
+		_ = f.removeLongName(ciphertextPath)
+		return mkdirErr(fmt.Sprintf("error creating directory %s: %s", ciphertextPath, err))
+	}
+
+	if f.plaintextNames {
+		f.fastCache.Store(cleanPath, ciphertextPath)
+		return nil
+	}
+
+	newIV := cryptocore.RandBytes(nametransform.DirIVLen)
+	ivPath := filepath.Join(ciphertextPath, nametransform.DirIVFilename)
+	_, err = f.fsAccessor.WriteFile(ivPath, newIV)
+	if err != nil {
+		// A directory without an IV is unusable, so try not to leave it
+		// behind.
+		_ = f.fsAccessor.Remove(ciphertextPath)
+		_ = f.removeLongName(ciphertextPath)
+		return mkdirErr(fmt.Sprintf("error writing directory IV %s: %s", ivPath, err))
+	}
+
+	f.fastCache.Store(cleanPath, ciphertextPath)
 	return nil
 }
 
+// Rename moves the file or directory at plainPath to target. It fails if
+// target already exists.
 func (f *FileTree) Rename(plainPath string, target string) error {
-	return errors.New("Not supported yet")
+	return f.rename(plainPath, target, false)
+}
+
+// PosixRename moves the file or directory at plainPath to target like
+// Rename does, except that an existing file at target is replaced, following
+// the semantics of the posix-rename@openssh.com extension.
+func (f *FileTree) PosixRename(plainPath string, target string) error {
+	return f.rename(plainPath, target, true)
+}
+
+func (f *FileTree) rename(plainPath string, target string, overwrite bool) error {
+	renameErr := func(msg string) error {
+		return fmt.Errorf("Rename: %s", msg)
+	}
+	cleanPath := filepath.Clean(plainPath)
+	cleanTarget := filepath.Clean(target)
+	if cleanPath == "/" || cleanTarget == "/" {
+		return renameErr("cannot rename /")
+	}
+	if cleanPath == cleanTarget {
+		return nil
+	}
+	if isUnder(cleanTarget, cleanPath) {
+		return renameErr(fmt.Sprintf("cannot move %s into itself", cleanPath))
+	}
+
+	cipherParentPath, err := f.findPath(filepath.Dir(cleanPath))
+	if err != nil {
+		return fmt.Errorf("Rename: error finding parent path: %w", err)
+	}
+	item, err := f.findInDir(cipherParentPath, filepath.Base(cleanPath))
+	if err != nil {
+		return fmt.Errorf("Rename: %w", err)
+	}
+	ciphertextPath := filepath.Join(cipherParentPath, item.Name())
+
+	targetParentPath, err := f.findPath(filepath.Dir(cleanTarget))
+	if err != nil {
+		return fmt.Errorf("Rename: error finding target parent path: %w", err)
+	}
+	targetName := filepath.Base(cleanTarget)
+	targetItem, err := f.findInDir(targetParentPath, targetName)
+	targetExists := err == nil
+	if targetExists {
+		if !overwrite {
+			return fmt.Errorf("Rename: %s: %w", cleanTarget, os.ErrExist)
+		}
+		// Replacing directories would require removing everything
+		// in them, including the directory IV.
+		if targetItem.IsDir() {
+			return renameErr(fmt.Sprintf("cannot replace directory %s", cleanTarget))
+		}
+		if item.IsDir() {
+			return renameErr(fmt.Sprintf("cannot replace file %s with a directory", cleanTarget))
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return renameErr(err.Error())
+	}
+
+	// Names are encrypted with the IV of their directory, so the name needs
+	// to be encrypted again for the target directory.
+	iv, err := f.dirIV(targetParentPath)
+	if err != nil {
+		return renameErr(err.Error())
+	}
+	targetCipherName, err := f.encryptName(targetParentPath, targetName, iv)
+	if err != nil {
+		return renameErr(fmt.Sprintf("error encrypting name %s: %s", targetName, err))
+	}
+	targetCiphertextPath := filepath.Join(targetParentPath, targetCipherName)
+	if !targetExists {
+		if err = f.writeLongName(targetCiphertextPath, targetName, iv); err != nil {
+			return renameErr(err.Error())
+		}
+	}
+
+	err = f.fsAccessor.Rename(ciphertextPath, targetCiphertextPath)
+	f.reqCacher.ClearDir(cipherParentPath)
+	f.reqCacher.ClearDir(targetParentPath)
+	f.reqCacher.ClearTree(ciphertextPath)
+	f.reqCacher.ClearTree(targetCiphertextPath)
+	if err != nil {
+		if !targetExists {
+			_ = f.removeLongName(targetCiphertextPath)
+		}
+		return renameErr(fmt.Sprintf("error renaming %s to %s: %s", ciphertextPath, targetCiphertextPath, err))
+	}
+	if item.IsDir() {
+		f.fastCache.Move(cleanPath, ciphertextPath, cleanTarget, targetCiphertextPath)
+	}
+	return f.removeLongName(ciphertextPath)
 }
 
+// Remove removes the file at plainPath.
 func (f *FileTree) Remove(plainPath string) error {
-	return errors.New("Not supported yet")
+	removeErr := func(msg string) error {
+		return fmt.Errorf("Remove: %s", msg)
+	}
+	cleanPath := filepath.Clean(plainPath)
+	if cleanPath == "/" {
+		return removeErr("/ is a directory")
+	}
+
+	ciphertextPath, item, err := f.resolve(cleanPath)
+	if err != nil {
+		return fmt.Errorf("Remove: %w", err)
+	}
+	cipherParentPath := filepath.Dir(ciphertextPath)
+	if item.IsDir() {
+		return removeErr(fmt.Sprintf("%s is a directory", cleanPath))
+	}
+
+	err = f.fsAccessor.Remove(ciphertextPath)
+	f.forgetEntry(cipherParentPath, item.Name())
+	if err != nil {
+		return removeErr(fmt.Sprintf("error removing %s: %s", ciphertextPath, err))
+	}
+	return f.removeLongName(ciphertextPath)
+}
+
+// Rmdir removes the empty directory at plainPath.
+func (f *FileTree) Rmdir(plainPath string) error {
+	rmdirErr := func(msg string) error {
+		return fmt.Errorf("Rmdir: %s", msg)
+	}
+	cleanPath := filepath.Clean(plainPath)
+	if cleanPath == "/" {
+		return rmdirErr("cannot remove /")
+	}
+
+	ciphertextPath, item, err := f.resolve(cleanPath)
+	if err != nil {
+		return fmt.Errorf("Rmdir: %w", err)
+	}
+	cipherParentPath := filepath.Dir(ciphertextPath)
+	if !item.IsDir() {
+		return rmdirErr(fmt.Sprintf("%s is not a directory", cleanPath))
+	}
+
+	// Check the current contents on the backend rather than what's cached,
+	// since everything in the directory is about to be orphaned.
+	dirListing, err := f.fsAccessor.ReadDir(ciphertextPath)
+	if err != nil {
+		return rmdirErr(fmt.Sprintf("error listing directory %s: %s", ciphertextPath, err))
+	}
+	for _, info := range dirListing {
+		if f.plaintextNames || info.Name() != nametransform.DirIVFilename {
+			return fmt.Errorf("Rmdir: %s: %w", cleanPath, syscall.ENOTEMPTY)
+		}
+	}
+
+	// The directory can only be removed once it's empty, so the directory
+	// IV goes first. Keep it around so that it can be restored if removing
+	// the directory fails.
+	var iv []byte
+	ivPath := filepath.Join(ciphertextPath, nametransform.DirIVFilename)
+	if !f.plaintextNames {
+		iv, err = f.dirIV(ciphertextPath)
+		if err != nil {
+			return rmdirErr(err.Error())
+		}
+		err = f.fsAccessor.Remove(ivPath)
+		if err != nil {
+			return rmdirErr(fmt.Sprintf("error removing directory IV %s: %s", ivPath, err))
+		}
+	}
+	err = f.fsAccessor.Remove(ciphertextPath)
+	if err != nil {
+		if iv != nil {
+			if _, restoreErr := f.fsAccessor.WriteFile(ivPath, iv); restoreErr != nil {
+				return rmdirErr(fmt.Sprintf("error removing %s: %s (restoring directory IV failed: %s)",
+					ciphertextPath, err, restoreErr))
+			}
+		}
+		return rmdirErr(fmt.Sprintf("error removing %s: %s", ciphertextPath, err))
+	}
+
+	f.forgetEntry(cipherParentPath, item.Name())
+	f.reqCacher.ClearTree(ciphertextPath)
+	f.fastCache.Delete(cleanPath)
+	return f.removeLongName(ciphertextPath)
 }
 
 /*
@@ -222,17 +621,39 @@ type listDirFn func(info os.FileInfo, plainName string) (exit bool)
 // encrypted path given by cipherPath. It passes the file info and decrypted to the
 // listDirFn, which is the operation to run for each iteration. If the fn
 // returns true, then the iteration will exit before the end of the iteration.
+// Files holding long names are skipped, and the entries they belong to are
+// passed with the decrypted long name instead.
 func (f *FileTree) rangeInDir(cipherPath string, fn listDirFn) error {
-	iv, err := f.reqCacher.ReadFile(filepath.Join(cipherPath, "gocryptfs.diriv"))
+	f.revalidate(cipherPath)
+	iv, err := f.dirIV(cipherPath)
 	if err != nil {
-		return fmt.Errorf("error reading directory IV: %s", err)
+		return err
 	}
 	dirListing, err := f.reqCacher.ReadDir(cipherPath)
 	if err != nil {
 		return fmt.Errorf("error listing directory: %s", err)
 	}
 	for _, info := range dirListing {
-		rName, err := f.reqCacher.DecryptName(info.Name(), iv)
+		cName := info.Name()
+		if f.plaintextNames {
+			if f.isReserved(cipherPath, cName) {
+				continue
+			}
+			if fn(info, cName) {
+				break
+			}
+			continue
+		}
+		switch nametransform.NameType(cName) {
+		case nametransform.LongNameFilename:
+			continue
+		case nametransform.LongNameContent:
+			cName, err = f.longName(filepath.Join(cipherPath, cName))
+			if err != nil {
+				continue
+			}
+		}
+		rName, err := f.reqCacher.DecryptName(cName, iv)
 		if err != nil {
 			continue
 		}
@@ -248,22 +669,189 @@ func (f *FileTree) rangeInDir(cipherPath string, fn listDirFn) error {
 // matches rName. It returns the fileInfo if it exists, and returns an error
 // if it doesn't.
 func (f *FileTree) findInDir(cipherPath, plainName string) (item os.FileInfo, err error) {
-	err = f.rangeInDir(cipherPath, func(info os.FileInfo, decryptedName string) bool {
-		if plainName == decryptedName {
-			item = info
-			return true
-		}
-		return false
-	})
+	f.revalidate(cipherPath)
+	iv, err := f.dirIV(cipherPath)
+	if err != nil {
+		return nil, fmt.Errorf("error iterating %s: %s", cipherPath, err)
+	}
+	cName, err := f.encryptName(cipherPath, plainName, iv)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting name %s: %w", plainName, err)
+	}
+	// Name encryption is deterministic, so the entry can be looked up by its
+	// encrypted name without decrypting any of the other names in the
+	// directory. Names longer than 176 bytes are stored under the hash of
+	// their encrypted name, which saves reading the long name files too.
+	item, err = f.findCipherName(cipherPath, cName)
 	if err != nil {
 		return nil, fmt.Errorf("error iterating %s: %s", cipherPath, err)
 	}
 	if item == nil {
-		return nil, fmt.Errorf("%s not found in %s", plainName, cipherPath)
+		return nil, fmt.Errorf("%s not found in %s: %w", plainName, cipherPath, os.ErrNotExist)
 	}
 	return
 }
 
+// findCipherName returns the file info of the entry named cName in the
+// directory located at the real encrypted path given by cipherPath, or nil if
+// there is no such entry.
+func (f *FileTree) findCipherName(cipherPath, cName string) (os.FileInfo, error) {
+	dirListing, err := f.reqCacher.ReadDir(cipherPath)
+	if err != nil {
+		return nil, fmt.Errorf("error listing directory: %s", err)
+	}
+	for _, info := range dirListing {
+		if info.Name() == cName {
+			return info, nil
+		}
+	}
+	return nil, nil
+}
+
+// longName reads the full encrypted name of the long name entry located at
+// the real encrypted path given by ciphertextPath.
+func (f *FileTree) longName(ciphertextPath string) (string, error) {
+	namePath := ciphertextPath + nametransform.LongNameSuffix
+	cName, err := f.reqCacher.ReadFile(namePath)
+	if err != nil {
+		return "", fmt.Errorf("error reading long name file %s: %s", namePath, err)
+	}
+	if len(cName) == 0 {
+		return "", fmt.Errorf("long name file %s is empty", namePath)
+	}
+	if len(cName) > longNameMax {
+		return "", fmt.Errorf("long name file %s is too big: size=%d > limit=%d",
+			namePath, len(cName), longNameMax)
+	}
+	return string(cName), nil
+}
+
+// writeLongName writes the full encrypted name of plainName next to
+// ciphertextPath if its name is a long name. iv is the directory IV of the
+// directory containing ciphertextPath.
+func (f *FileTree) writeLongName(ciphertextPath string, plainName string, iv []byte) error {
+	if f.plaintextNames || !nametransform.IsLongContent(filepath.Base(ciphertextPath)) {
+		return nil
+	}
+	namePath := ciphertextPath + nametransform.LongNameSuffix
+	_, err := f.fsAccessor.WriteFile(namePath, []byte(f.nTransform.EncryptName(plainName, iv)))
+	f.reqCacher.ClearFile(namePath)
+	if err != nil {
+		return fmt.Errorf("error writing long name file %s: %s", namePath, err)
+	}
+	return nil
+}
+
+// forgetEntry purges everything cached about the entry cipherName in the
+// directory at cipherParentPath, along with the listing of the directory.
+func (f *FileTree) forgetEntry(cipherParentPath, cipherName string) {
+	f.reqCacher.ClearDir(cipherParentPath)
+	f.reqCacher.ClearFile(filepath.Join(cipherParentPath, cipherName))
+	if iv, err := f.dirIV(cipherParentPath); err == nil {
+		f.reqCacher.ClearName(cipherName, iv)
+	}
+}
+
+// removeLongName removes the file holding the full encrypted name of
+// ciphertextPath if it has a long name.
+func (f *FileTree) removeLongName(ciphertextPath string) error {
+	if f.plaintextNames || !nametransform.IsLongContent(filepath.Base(ciphertextPath)) {
+		return nil
+	}
+	namePath := ciphertextPath + nametransform.LongNameSuffix
+	err := f.fsAccessor.Remove(namePath)
+	f.reqCacher.ClearFile(namePath)
+	if err != nil {
+		return fmt.Errorf("error removing long name file %s: %s", namePath, err)
+	}
+	return nil
+}
+
+// dirIV reads the directory IV of the directory located at the real encrypted
+// path given by cipherPath. It returns a nil IV for filesystems with
+// plaintext names.
+func (f *FileTree) dirIV(cipherPath string) ([]byte, error) {
+	if f.plaintextNames {
+		return nil, nil
+	}
+	iv, err := f.reqCacher.ReadFile(filepath.Join(cipherPath, nametransform.DirIVFilename))
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory IV: %s", err)
+	}
+	return iv, nil
+}
+
+// encryptName encrypts plainName with the directory IV iv of the directory
+// located at cipherDirPath, hashing it to a long name if necessary. It returns
+// ENAMETOOLONG if the resulting name can't be stored on the backend.
+func (f *FileTree) encryptName(cipherDirPath string, plainName string, iv []byte) (string, error) {
+	if f.plaintextNames {
+		if len(plainName) > nametransform.NameMax {
+			return "", syscall.ENAMETOOLONG
+		}
+		if f.isReserved(cipherDirPath, plainName) {
+			return "", syscall.EPERM
+		}
+		return plainName, nil
+	}
+	cipherName, err := f.nTransform.EncryptAndHashName(plainName, iv)
+	if err != nil {
+		return "", err
+	}
+	if len(cipherName) > nametransform.NameMax {
+		return "", syscall.ENAMETOOLONG
+	}
+	return cipherName, nil
+}
+
+// isReserved returns true if cName in the directory located at cipherDirPath
+// belongs to gocryptfs rather than the plaintext view of the filesystem. This
+// is only the case for the config file in the root directory of filesystems
+// with plaintext names.
+func (f *FileTree) isReserved(cipherDirPath string, cName string) bool {
+	return f.plaintextNames && cName == configfile.ConfDefaultName &&
+		filepath.Clean(cipherDirPath) == filepath.Clean(f.encryptedRoot)
+}
+
+// resolve finds the ciphertext path of the file or directory at plainPath,
+// along with its file info. The file info comes from the listing of the
+// parent directory, except for the root, which has to be looked up on the
+// backend.
+func (f *FileTree) resolve(plainPath string) (string, os.FileInfo, error) {
+	cleanPath := filepath.Clean(plainPath)
+	if cleanPath == "/" {
+		item, err := f.fsAccessor.Stat(f.encryptedRoot)
+		if err != nil {
+			return "", nil, fmt.Errorf("error running stat on %s: %w", f.encryptedRoot, err)
+		}
+		return f.encryptedRoot, item, nil
+	}
+
+	cipherParentPath, err := f.findPath(filepath.Dir(cleanPath))
+	if err != nil {
+		return "", nil, fmt.Errorf("error finding parent path: %w", err)
+	}
+	item, err := f.findInDir(cipherParentPath, filepath.Base(cleanPath))
+	if err != nil {
+		return "", nil, err
+	}
+	return filepath.Join(cipherParentPath, item.Name()), item, nil
+}
+
+// plainInfo returns the file info of a ciphertext entry as it appears in the
+// plaintext view, under the name plainName.
+func (f *FileTree) plainInfo(info os.FileInfo, plainName string) os.FileInfo {
+	size := info.Size()
+	if !info.IsDir() {
+		size = int64(f.cEnc.CipherSizeToPlainSize(uint64(size)))
+	}
+	return plainFileInfo{
+		FileInfo: info,
+		name:     plainName,
+		size:     size,
+	}
+}
+
 // findPath attempts to find the ciphertext path corresponding to the plaintext
 // path by discovering as much as possible about the ciphertext path from the
 // fastCache, and then walking the directory tree down the rest of the way. It
@@ -292,7 +880,7 @@ func (f *FileTree) findPath(plainPath string) (string, error) {
 	}
 	ciphertextPath := filepath.Join(cipherParentPath, item.Name())
 	if !item.IsDir() {
-		return "", fmt.Errorf("%s is not a directory", ciphertextPath)
+		return "", fmt.Errorf("%s: %w", ciphertextPath, syscall.ENOTDIR)
 	}
 	f.fastCache.Store(cleanPath, ciphertextPath)
 	return ciphertextPath, nil
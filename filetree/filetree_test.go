@@ -0,0 +1,969 @@
+package filetree_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+	"github.com/flawedmatrix/gocryptsftp/filetree/filetreefakes"
+	"github.com/flawedmatrix/gocryptsftp/filetree/filetreetest"
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/configfile"
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/contentenc"
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/cryptocore"
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/nametransform"
+	"github.com/flawedmatrix/gocryptsftp/requester"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileTree", func() {
+	var (
+		mfs  *filetreetest.MemFS
+		fake *filetreefakes.FakeFSAccessor
+		ft   *filetree.FileTree
+	)
+
+	BeforeEach(func() {
+		mfs = filetreetest.NewMemFS()
+		newEncryptedRoot(mfs, nil, filetreetest.VolumeOptions{})
+		fake = mfs.Fake()
+		ft = initFileTree(fake)
+	})
+
+	Describe("WriteFile", func() {
+		var plaintext []byte
+
+		BeforeEach(func() {
+			// Spans multiple blocks, with a partial last block
+			plaintext = bytes.Repeat([]byte("0123456789"), 1000)
+		})
+
+		It("writes a file that can be read back", func() {
+			n, err := ft.WriteFile("/foo.txt", plaintext)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(BeEquivalentTo(len(plaintext)))
+
+			b, err := ft.ReadFile("/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(Equal(plaintext))
+		})
+
+		It("stores the file with an encrypted name and encrypted content", func() {
+			_, err := ft.WriteFile("/foo.txt", plaintext)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fake.WriteFileCallCount()).To(Equal(1))
+			tmpPath, cipherBytes := fake.WriteFileArgsForCall(0)
+			Expect(fake.RenameCallCount()).To(Equal(1))
+			renamed, cipherPath := fake.RenameArgsForCall(0)
+			Expect(renamed).To(Equal(tmpPath))
+			Expect(filepath.Dir(cipherPath)).To(Equal(testEncryptedRoot))
+			Expect(filepath.Base(cipherPath)).NotTo(ContainSubstring("foo"))
+
+			Expect(len(cipherBytes)).To(BeNumerically(">", len(plaintext)+contentenc.HeaderLen))
+			Expect(bytes.Contains(cipherBytes, []byte("0123456789"))).To(BeFalse())
+		})
+
+		It("shows the file in directory listings with its plaintext size", func() {
+			_, err := ft.WriteFile("/foo.txt", plaintext)
+			Expect(err).NotTo(HaveOccurred())
+
+			listing, err := ft.ReadDir("/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listing).To(HaveLen(1))
+			Expect(listing[0].Name()).To(Equal("foo.txt"))
+			Expect(listing[0].Size()).To(BeEquivalentTo(len(plaintext)))
+		})
+
+		It("writes empty files without a header", func() {
+			_, err := ft.WriteFile("/empty", []byte{})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, cipherBytes := fake.WriteFileArgsForCall(0)
+			Expect(cipherBytes).To(BeEmpty())
+		})
+
+		It("replaces the contents of existing files", func() {
+			_, err := ft.WriteFile("/foo.txt", plaintext)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = ft.ReadFile("/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = ft.WriteFile("/foo.txt", []byte("new contents"))
+			Expect(err).NotTo(HaveOccurred())
+
+			b, err := ft.ReadFile("/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(Equal([]byte("new contents")))
+
+			listing, err := ft.ReadDir("/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listing).To(HaveLen(1))
+		})
+
+		It("leaves the old file as it was when the upload fails", func() {
+			_, err := ft.WriteFile("/foo.txt", plaintext)
+			Expect(err).NotTo(HaveOccurred())
+			before := mfs.Paths(testEncryptedRoot)
+
+			fake.WriteFileStub = func(path string, data []byte) (int64, error) {
+				// Part of the file made it before the connection dropped
+				_, _ = mfs.WriteFile(path, data[:10])
+				return 0, errors.New("connection lost")
+			}
+			_, err = ft.WriteFile("/foo.txt", []byte("new contents"))
+			Expect(err).To(MatchError(ContainSubstring("connection lost")))
+
+			Expect(mfs.Paths(testEncryptedRoot)).To(Equal(before))
+			b, err := ft.ReadFile("/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(Equal(plaintext))
+		})
+
+		It("removes the uploaded file when it can't be renamed over the old one", func() {
+			_, err := ft.WriteFile("/foo.txt", plaintext)
+			Expect(err).NotTo(HaveOccurred())
+			before := mfs.Paths(testEncryptedRoot)
+
+			fake.RenameReturns(errors.New("permission denied"))
+			_, err = ft.WriteFile("/foo.txt", []byte("new contents"))
+			Expect(err).To(MatchError(ContainSubstring("permission denied")))
+
+			Expect(mfs.Paths(testEncryptedRoot)).To(Equal(before))
+			b, err := ft.ReadFile("/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(Equal(plaintext))
+		})
+
+		It("returns an error when the parent directory doesn't exist", func() {
+			_, err := ft.WriteFile("/nonexistent/foo.txt", plaintext)
+			Expect(err).To(MatchError(ContainSubstring("error finding parent path")))
+			Expect(fake.WriteFileCallCount()).To(BeZero())
+		})
+
+		It("returns an error when the name is too long", func() {
+			name := string(bytes.Repeat([]byte("a"), nametransform.NameMax+1))
+			_, err := ft.WriteFile("/"+name, plaintext)
+			Expect(err).To(HaveOccurred())
+			Expect(fake.WriteFileCallCount()).To(BeZero())
+		})
+	})
+
+	Describe("Mkdir", func() {
+		It("creates an encrypted directory with a new directory IV", func() {
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+
+			Expect(fake.MkdirCallCount()).To(Equal(1))
+			cipherPath := fake.MkdirArgsForCall(0)
+			Expect(filepath.Dir(cipherPath)).To(Equal(testEncryptedRoot))
+			Expect(filepath.Base(cipherPath)).NotTo(ContainSubstring("dir"))
+
+			iv, err := mfs.ReadFile(filepath.Join(cipherPath, nametransform.DirIVFilename))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(iv).To(HaveLen(nametransform.DirIVLen))
+
+			rootIV, err := mfs.ReadFile(filepath.Join(testEncryptedRoot, nametransform.DirIVFilename))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(iv).NotTo(Equal(rootIV))
+		})
+
+		It("makes the directory visible in its parent right away", func() {
+			_, err := ft.ReadDir("/")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+
+			listing, err := ft.ReadDir("/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listing).To(HaveLen(1))
+			Expect(listing[0].Name()).To(Equal("dir"))
+			Expect(listing[0].IsDir()).To(BeTrue())
+		})
+
+		It("allows creating files and directories inside the new directory", func() {
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+			Expect(ft.Mkdir("/dir/subdir")).To(Succeed())
+			_, err := ft.WriteFile("/dir/subdir/foo.txt", []byte("contents"))
+			Expect(err).NotTo(HaveOccurred())
+
+			b, err := ft.ReadFile("/dir/subdir/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(Equal([]byte("contents")))
+		})
+
+		It("remembers where the new directory is without listing its parent", func() {
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+			callsBefore := fake.ReadDirCallCount()
+			_, err := ft.ReadDir("/dir")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fake.ReadDirCallCount()).To(BeNumerically(">", callsBefore))
+			for i := callsBefore; i < fake.ReadDirCallCount(); i++ {
+				Expect(fake.ReadDirArgsForCall(i)).NotTo(Equal(testEncryptedRoot))
+			}
+		})
+
+		It("returns an error when the directory already exists", func() {
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+			err := ft.Mkdir("/dir")
+			Expect(errors.Is(err, os.ErrExist)).To(BeTrue())
+			Expect(fake.MkdirCallCount()).To(Equal(1))
+		})
+
+		It("returns an error when the parent doesn't exist", func() {
+			err := ft.Mkdir("/nonexistent/dir")
+			Expect(err).To(MatchError(ContainSubstring("error finding parent path")))
+			Expect(fake.MkdirCallCount()).To(BeZero())
+		})
+	})
+
+	Describe("Rename", func() {
+		BeforeEach(func() {
+			Expect(ft.Mkdir("/src")).To(Succeed())
+			Expect(ft.Mkdir("/src/sub")).To(Succeed())
+			Expect(ft.Mkdir("/dst")).To(Succeed())
+			_, err := ft.WriteFile("/src/foo.txt", []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = ft.WriteFile("/src/sub/bar.txt", []byte("bar"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		expectContents := func(plainPath string, contents string) {
+			b, err := ft.ReadFile(plainPath)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			ExpectWithOffset(1, string(b)).To(Equal(contents))
+		}
+
+		expectNotExist := func(plainPath string) {
+			_, err := ft.ReadFile(plainPath)
+			ExpectWithOffset(1, errors.Is(err, os.ErrNotExist)).To(BeTrue(), "expected %s not to exist", plainPath)
+		}
+
+		It("renames files within a directory", func() {
+			Expect(ft.Rename("/src/foo.txt", "/src/renamed.txt")).To(Succeed())
+			expectContents("/src/renamed.txt", "foo")
+			expectNotExist("/src/foo.txt")
+		})
+
+		It("moves files across directories, encrypting the name for the new directory", func() {
+			Expect(ft.Rename("/src/foo.txt", "/dst/foo.txt")).To(Succeed())
+			expectContents("/dst/foo.txt", "foo")
+			expectNotExist("/src/foo.txt")
+
+			oldCipherPath, newCipherPath := fake.RenameArgsForCall(0)
+			Expect(filepath.Base(newCipherPath)).NotTo(Equal(filepath.Base(oldCipherPath)))
+		})
+
+		It("moves directories along with everything in them", func() {
+			_, err := ft.ReadDir("/src/sub")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ft.Rename("/src", "/dst/moved")).To(Succeed())
+			expectContents("/dst/moved/foo.txt", "foo")
+			expectContents("/dst/moved/sub/bar.txt", "bar")
+			expectNotExist("/src/sub/bar.txt")
+
+			listing, err := ft.ReadDir("/dst/moved/sub")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listing).To(HaveLen(1))
+			Expect(listing[0].Name()).To(Equal("bar.txt"))
+		})
+
+		It("fails when the target already exists", func() {
+			_, err := ft.WriteFile("/dst/foo.txt", []byte("existing"))
+			Expect(err).NotTo(HaveOccurred())
+
+			renames := fake.RenameCallCount()
+			err = ft.Rename("/src/foo.txt", "/dst/foo.txt")
+			Expect(errors.Is(err, os.ErrExist)).To(BeTrue())
+			expectContents("/dst/foo.txt", "existing")
+			Expect(fake.RenameCallCount()).To(Equal(renames))
+		})
+
+		It("fails when moving a directory into itself", func() {
+			renames := fake.RenameCallCount()
+			Expect(ft.Rename("/src", "/src/sub/src")).NotTo(Succeed())
+			Expect(fake.RenameCallCount()).To(Equal(renames))
+		})
+
+		It("fails when the source doesn't exist", func() {
+			err := ft.Rename("/src/nonexistent", "/dst/foo.txt")
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		})
+
+		Context("with posix-rename semantics", func() {
+			It("replaces existing files", func() {
+				_, err := ft.WriteFile("/dst/foo.txt", []byte("existing"))
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(ft.PosixRename("/src/foo.txt", "/dst/foo.txt")).To(Succeed())
+				expectContents("/dst/foo.txt", "foo")
+				expectNotExist("/src/foo.txt")
+
+				listing, err := ft.ReadDir("/dst")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(listing).To(HaveLen(1))
+			})
+
+			It("refuses to replace directories", func() {
+				renames := fake.RenameCallCount()
+				Expect(ft.PosixRename("/src/foo.txt", "/src/sub")).NotTo(Succeed())
+				Expect(fake.RenameCallCount()).To(Equal(renames))
+			})
+		})
+	})
+
+	Describe("Remove", func() {
+		BeforeEach(func() {
+			_, err := ft.WriteFile("/foo.txt", []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+		})
+
+		It("removes files", func() {
+			_, err := ft.ReadFile("/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ft.Remove("/foo.txt")).To(Succeed())
+			_, err = ft.ReadFile("/foo.txt")
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+
+			listing, err := ft.ReadDir("/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listing).To(HaveLen(1))
+			Expect(listing[0].Name()).To(Equal("dir"))
+		})
+
+		It("refuses to remove directories", func() {
+			Expect(ft.Remove("/dir")).NotTo(Succeed())
+			Expect(fake.RemoveCallCount()).To(BeZero())
+		})
+
+		It("returns a not exist error when the file doesn't exist", func() {
+			err := ft.Remove("/nonexistent")
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		})
+	})
+
+	Describe("Rmdir", func() {
+		BeforeEach(func() {
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+		})
+
+		It("removes empty directories along with their directory IV", func() {
+			Expect(ft.Rmdir("/dir")).To(Succeed())
+			Expect(mfs.Paths(testEncryptedRoot)).To(ConsistOf(
+				filepath.Join(testEncryptedRoot, nametransform.DirIVFilename),
+				filepath.Join(testEncryptedRoot, configfile.ConfDefaultName),
+			))
+
+			listing, err := ft.ReadDir("/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listing).To(BeEmpty())
+		})
+
+		It("forgets the location of removed directories", func() {
+			Expect(ft.Rmdir("/dir")).To(Succeed())
+			_, err := ft.ReadDir("/dir")
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+			_, err = ft.WriteFile("/dir/foo.txt", []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("refuses to remove directories that aren't empty", func() {
+			_, err := ft.WriteFile("/dir/foo.txt", []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ft.Rmdir("/dir")
+			Expect(errors.Is(err, syscall.ENOTEMPTY)).To(BeTrue())
+			Expect(fake.RemoveCallCount()).To(BeZero())
+
+			b, err := ft.ReadFile("/dir/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(Equal("foo"))
+		})
+
+		It("restores the directory IV if the directory can't be removed", func() {
+			fake.RemoveCalls(func(path string) error {
+				if filepath.Base(path) == nametransform.DirIVFilename {
+					return mfs.Remove(path)
+				}
+				return errors.New("remove failed")
+			})
+			Expect(ft.Rmdir("/dir")).NotTo(Succeed())
+
+			var dirIVs []string
+			for _, p := range mfs.Paths(testEncryptedRoot) {
+				if filepath.Base(p) == nametransform.DirIVFilename {
+					dirIVs = append(dirIVs, p)
+				}
+			}
+			Expect(dirIVs).To(HaveLen(2))
+		})
+
+		It("refuses to remove files", func() {
+			_, err := ft.WriteFile("/foo.txt", []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ft.Rmdir("/foo.txt")).NotTo(Succeed())
+			Expect(fake.RemoveCallCount()).To(BeZero())
+		})
+
+		It("refuses to remove the root", func() {
+			Expect(ft.Rmdir("/")).NotTo(Succeed())
+		})
+	})
+
+	Describe("long names", func() {
+		var longName string
+
+		BeforeEach(func() {
+			// Long enough for the encrypted name to exceed 255 bytes
+			longName = string(bytes.Repeat([]byte("x"), 200))
+		})
+
+		longNameFiles := func() []string {
+			var names []string
+			for _, p := range mfs.Paths(testEncryptedRoot) {
+				if nametransform.NameType(filepath.Base(p)) != nametransform.LongNameNone {
+					names = append(names, filepath.Base(p))
+				}
+			}
+			return names
+		}
+
+		It("stores files under a hashed name along with the full encrypted name", func() {
+			_, err := ft.WriteFile("/"+longName, []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+
+			names := longNameFiles()
+			Expect(names).To(HaveLen(2))
+			Expect(nametransform.IsLongContent(names[0])).To(BeTrue())
+			Expect(names[1]).To(Equal(names[0] + nametransform.LongNameSuffix))
+
+			b, err := ft.ReadFile("/" + longName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(Equal("foo"))
+		})
+
+		It("lists long names without the files holding them", func() {
+			_, err := ft.WriteFile("/"+longName, []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ft.Mkdir("/short")).To(Succeed())
+
+			listing, err := ft.ReadDir("/")
+			Expect(err).NotTo(HaveOccurred())
+			var names []string
+			for _, info := range listing {
+				names = append(names, info.Name())
+			}
+			Expect(names).To(ConsistOf(longName, "short"))
+		})
+
+		It("looks up long names without reading unrelated long name files", func() {
+			_, err := ft.WriteFile("/"+longName, []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+			otherName := string(bytes.Repeat([]byte("y"), 200))
+			_, err = ft.WriteFile("/"+otherName, []byte("bar"))
+			Expect(err).NotTo(HaveOccurred())
+
+			ft = initFileTree(fake)
+			readsBefore := fake.ReadFileCallCount()
+			b, err := ft.ReadFile("/" + otherName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(Equal("bar"))
+			for i := readsBefore; i < fake.ReadFileCallCount(); i++ {
+				Expect(fake.ReadFileArgsForCall(i)).NotTo(HaveSuffix(nametransform.LongNameSuffix))
+			}
+		})
+
+		It("looks up short names without reading any long name files", func() {
+			_, err := ft.WriteFile("/"+longName, []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = ft.WriteFile("/short", []byte("bar"))
+			Expect(err).NotTo(HaveOccurred())
+
+			ft = initFileTree(fake)
+			readsBefore := fake.ReadFileCallCount()
+			b, err := ft.ReadFile("/short")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(Equal("bar"))
+			_, err = ft.Stat("/missing")
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+			for i := readsBefore; i < fake.ReadFileCallCount(); i++ {
+				Expect(fake.ReadFileArgsForCall(i)).NotTo(HaveSuffix(nametransform.LongNameSuffix))
+			}
+		})
+
+		It("supports directories with long names", func() {
+			Expect(ft.Mkdir("/" + longName)).To(Succeed())
+			_, err := ft.WriteFile("/"+longName+"/foo.txt", []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+
+			ft = initFileTree(fake)
+			b, err := ft.ReadFile("/" + longName + "/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(Equal("foo"))
+		})
+
+		It("moves the full encrypted name when renaming", func() {
+			_, err := ft.WriteFile("/"+longName, []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+			otherName := string(bytes.Repeat([]byte("y"), 200))
+
+			Expect(ft.Rename("/"+longName, "/"+otherName)).To(Succeed())
+			Expect(longNameFiles()).To(HaveLen(2))
+			b, err := ft.ReadFile("/" + otherName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(Equal("foo"))
+
+			Expect(ft.Rename("/"+otherName, "/short")).To(Succeed())
+			Expect(longNameFiles()).To(BeEmpty())
+		})
+
+		It("removes the full encrypted name along with the file", func() {
+			_, err := ft.WriteFile("/"+longName, []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ft.Remove("/" + longName)).To(Succeed())
+			Expect(longNameFiles()).To(BeEmpty())
+
+			Expect(ft.Mkdir("/" + longName)).To(Succeed())
+			Expect(ft.Rmdir("/" + longName)).To(Succeed())
+			Expect(longNameFiles()).To(BeEmpty())
+		})
+	})
+
+	Context("with plaintext names", func() {
+		BeforeEach(func() {
+			mfs = filetreetest.NewMemFS()
+			newEncryptedRoot(mfs, nil, filetreetest.VolumeOptions{PlaintextNames: true})
+			fake = mfs.Fake()
+			ft = initFileTree(fake)
+		})
+
+		It("stores files and directories under their plaintext names", func() {
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+			_, err := ft.WriteFile("/dir/foo.txt", []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(mfs.Paths(testEncryptedRoot)).To(ConsistOf(
+				filepath.Join(testEncryptedRoot, configfile.ConfDefaultName),
+				filepath.Join(testEncryptedRoot, "dir"),
+				filepath.Join(testEncryptedRoot, "dir", "foo.txt"),
+			))
+			contents, err := mfs.ReadFile(filepath.Join(testEncryptedRoot, "dir", "foo.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).NotTo(ContainSubstring("foo"))
+
+			b, err := ft.ReadFile("/dir/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(Equal("foo"))
+		})
+
+		It("never looks for directory IVs", func() {
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+			_, err := ft.WriteFile("/dir/foo.txt", []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = ft.ReadDir("/dir")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ft.Rename("/dir/foo.txt", "/bar.txt")).To(Succeed())
+			Expect(ft.Rmdir("/dir")).To(Succeed())
+
+			for i := 0; i < fake.ReadFileCallCount(); i++ {
+				Expect(fake.ReadFileArgsForCall(i)).NotTo(HaveSuffix(nametransform.DirIVFilename))
+			}
+		})
+
+		It("hides the config file", func() {
+			_, err := ft.WriteFile("/foo.txt", []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+
+			listing, err := ft.ReadDir("/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listing).To(HaveLen(1))
+			Expect(listing[0].Name()).To(Equal("foo.txt"))
+
+			_, err = ft.WriteFile("/"+configfile.ConfDefaultName, []byte("foo"))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("doesn't treat names that look like long names specially", func() {
+			name := "gocryptfs.longname.foo"
+			_, err := ft.WriteFile("/"+name, []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mfs.Paths(testEncryptedRoot)).To(HaveLen(2))
+			Expect(ft.Remove("/" + name)).To(Succeed())
+		})
+	})
+
+	Context("with AES-SIV content encryption", func() {
+		const aessivConf = "../gocrypt/configfile/config_test/AESSIV.conf"
+
+		var (
+			cEnc       *contentenc.ContentEnc
+			nTransform *nametransform.NameTransform
+		)
+
+		BeforeEach(func() {
+			mfs = filetreetest.NewMemFS()
+			newEncryptedRoot(mfs, nil, filetreetest.VolumeOptions{ConfPath: aessivConf})
+			fake = mfs.Fake()
+			ft = initFileTree(fake)
+
+			masterKey, _, err := configfile.LoadAndDecrypt(aessivConf, []byte(testPassword))
+			Expect(err).NotTo(HaveOccurred())
+			cCore := cryptocore.New(masterKey, cryptocore.BackendAESSIV, contentenc.DefaultIVBits, true, false)
+			cEnc = contentenc.New(cCore, contentenc.DefaultBS, false)
+			nTransform = nametransform.New(cCore.EMECipher, true, true)
+		})
+
+		It("decrypts files encrypted with AES-SIV", func() {
+			iv, err := mfs.ReadFile(filepath.Join(testEncryptedRoot, nametransform.DirIVFilename))
+			Expect(err).NotTo(HaveOccurred())
+			header := contentenc.RandomHeader()
+			ciphertext := append(header.Pack(), cEnc.EncryptBlock([]byte("foo"), 0, header.ID)...)
+			_, err = mfs.WriteFile(filepath.Join(testEncryptedRoot, nTransform.EncryptName("foo.txt", iv)), ciphertext)
+			Expect(err).NotTo(HaveOccurred())
+
+			b, err := ft.ReadFile("/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(Equal("foo"))
+		})
+
+		It("encrypts files with AES-SIV", func() {
+			_, err := ft.WriteFile("/foo.txt", []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+
+			ciphertextPath, ciphertext := fake.WriteFileArgsForCall(fake.WriteFileCallCount() - 1)
+			Expect(filepath.Dir(ciphertextPath)).To(Equal(testEncryptedRoot))
+			header, err := contentenc.ParseHeader(ciphertext[:contentenc.HeaderLen])
+			Expect(err).NotTo(HaveOccurred())
+			plaintext, err := cEnc.DecryptBlock(ciphertext[contentenc.HeaderLen:], 0, header.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(plaintext)).To(Equal("foo"))
+		})
+	})
+
+	Describe("Open", func() {
+		var plaintext []byte
+
+		BeforeEach(func() {
+			// Large enough to need several fetches from the backend
+			plaintext = make([]byte, 300*1024+123)
+			rand.New(rand.NewSource(1)).Read(plaintext)
+			_, err := ft.WriteFile("/big", plaintext)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("reads arbitrary ranges of the file", func() {
+			r, err := ft.Open("/big")
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, rng := range [][2]int{
+				{0, 10}, {4000, 200}, {4096, 4096}, {100000, 100000}, {131000, 2000}, {0, len(plaintext)},
+			} {
+				buf := make([]byte, rng[1])
+				n, err := r.ReadAt(buf, int64(rng[0]))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(n).To(Equal(rng[1]))
+				Expect(buf).To(Equal(plaintext[rng[0] : rng[0]+rng[1]]))
+			}
+		})
+
+		It("only fetches the blocks that are needed", func() {
+			r, err := ft.Open("/big")
+			Expect(err).NotTo(HaveOccurred())
+
+			buf := make([]byte, 4096)
+			_, err = r.ReadAt(buf, 0)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = r.ReadAt(buf, 8192)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(mfs.BytesRead()).To(BeNumerically("<", len(plaintext)/2))
+			for i := 0; i < fake.ReadFileCallCount(); i++ {
+				Expect(filepath.Base(fake.ReadFileArgsForCall(i))).To(Or(
+					Equal(nametransform.DirIVFilename),
+					Equal(configfile.ConfDefaultName),
+				))
+			}
+		})
+
+		It("keeps the file open on the backend until the reader is closed", func() {
+			r, err := ft.Open("/big")
+			Expect(err).NotTo(HaveOccurred())
+
+			var read []byte
+			buf := make([]byte, 4096)
+			for err == nil {
+				var n int
+				n, err = r.ReadAt(buf, int64(len(read)))
+				read = append(read, buf[:n]...)
+			}
+			Expect(err).To(Equal(io.EOF))
+			Expect(read).To(Equal(plaintext))
+			Expect(fake.OpenCallCount()).To(Equal(1))
+			Expect(mfs.OpenFiles()).To(Equal(1))
+
+			Expect(r.Close()).To(Succeed())
+			Expect(mfs.OpenFiles()).To(BeZero())
+			_, err = r.ReadAt(buf, 0)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("closes the file on the backend after reading all of it", func() {
+			b, err := ft.ReadFile("/big")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(Equal(plaintext))
+			Expect(mfs.OpenFiles()).To(BeZero())
+		})
+
+		It("returns io.EOF when reading past the end of the file", func() {
+			r, err := ft.Open("/big")
+			Expect(err).NotTo(HaveOccurred())
+
+			buf := make([]byte, 1000)
+			n, err := r.ReadAt(buf, int64(len(plaintext)-100))
+			Expect(err).To(Equal(io.EOF))
+			Expect(n).To(Equal(100))
+			Expect(buf[:n]).To(Equal(plaintext[len(plaintext)-100:]))
+
+			n, err = r.ReadAt(buf, int64(len(plaintext)))
+			Expect(err).To(Equal(io.EOF))
+			Expect(n).To(BeZero())
+		})
+
+		It("reads empty files", func() {
+			_, err := ft.WriteFile("/empty", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			r, err := ft.Open("/empty")
+			Expect(err).NotTo(HaveOccurred())
+			n, err := r.ReadAt(make([]byte, 10), 0)
+			Expect(err).To(Equal(io.EOF))
+			Expect(n).To(BeZero())
+		})
+
+		It("returns an error for directories", func() {
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+			_, err := ft.Open("/dir")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Stat", func() {
+		BeforeEach(func() {
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+			_, err := ft.WriteFile("/dir/foo.txt", []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("returns the plaintext name and size of files", func() {
+			info, err := ft.Stat("/dir/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Name()).To(Equal("foo.txt"))
+			Expect(info.Size()).To(Equal(int64(3)))
+			Expect(info.IsDir()).To(BeFalse())
+		})
+
+		It("returns the plaintext name of directories", func() {
+			info, err := ft.Stat("/dir")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Name()).To(Equal("dir"))
+			Expect(info.IsDir()).To(BeTrue())
+		})
+
+		It("uses the listing of the parent directory instead of stat", func() {
+			_, err := ft.ReadDir("/")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = ft.ReadDir("/dir")
+			Expect(err).NotTo(HaveOccurred())
+			readDirs := fake.ReadDirCallCount()
+			stats := fake.StatCallCount()
+
+			_, err = ft.Stat("/dir/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = ft.Stat("/dir")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fake.StatCallCount()).To(Equal(stats))
+			Expect(fake.ReadDirCallCount()).To(Equal(readDirs))
+		})
+
+		It("stats the root on the backend", func() {
+			stats := fake.StatCallCount()
+			info, err := ft.Stat("/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.IsDir()).To(BeTrue())
+			Expect(fake.StatCallCount()).To(Equal(stats + 1))
+			Expect(fake.StatArgsForCall(stats)).To(Equal(testEncryptedRoot))
+		})
+
+		It("returns a not exist error when the path doesn't exist", func() {
+			_, err := ft.Stat("/dir/nonexistent")
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+			_, err = ft.Stat("/nonexistent/foo.txt")
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		})
+
+		It("returns an error when a parent is a file", func() {
+			_, err := ft.Stat("/dir/foo.txt/bar")
+			Expect(errors.Is(err, syscall.ENOTDIR)).To(BeTrue())
+		})
+	})
+
+	Describe("revalidation", func() {
+		var other *filetree.FileTree
+
+		names := func(dir string) []string {
+			listing, err := ft.ReadDir(dir)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			var names []string
+			for _, info := range listing {
+				names = append(names, info.Name())
+			}
+			return names
+		}
+
+		BeforeEach(func() {
+			opts := filetree.DefaultOptions()
+			opts.RevalidateInterval = 20 * time.Millisecond
+			ft = initFileTreeWithOptions(fake, opts)
+			// Another client of the same backend, whose changes ft can only
+			// notice through the backend.
+			other = initFileTree(mfs.Fake())
+
+			Expect(ft.Mkdir("/dir")).To(Succeed())
+			_, err := ft.WriteFile("/dir/foo.txt", []byte("foo"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names("/dir")).To(ConsistOf("foo.txt"))
+		})
+
+		It("keeps serving the cached listing within the interval", func() {
+			_, err := other.WriteFile("/dir/bar.txt", []byte("bar"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names("/dir")).To(ConsistOf("foo.txt"))
+		})
+
+		It("refreshes the listing once the directory changed", func() {
+			_, err := other.WriteFile("/dir/bar.txt", []byte("bar"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() []string {
+				return names("/dir")
+			}).Should(ConsistOf("foo.txt", "bar.txt"))
+
+			b, err := ft.ReadFile("/dir/bar.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(Equal([]byte("bar")))
+		})
+
+		It("only stats the directory while it's unchanged", func() {
+			// The first checks after ft's own changes to the directories
+			// refresh them.
+			time.Sleep(30 * time.Millisecond)
+			Expect(names("/")).To(ConsistOf("dir"))
+			Expect(names("/dir")).To(ConsistOf("foo.txt"))
+			time.Sleep(30 * time.Millisecond)
+			readDirs := fake.ReadDirCallCount()
+			stats := fake.StatCallCount()
+
+			Expect(names("/dir")).To(ConsistOf("foo.txt"))
+			Expect(fake.ReadDirCallCount()).To(Equal(readDirs))
+			Expect(fake.StatCallCount()).To(BeNumerically(">", stats))
+		})
+
+		It("refreshes the directory IV of a directory that was replaced", func() {
+			Expect(other.Remove("/dir/foo.txt")).To(Succeed())
+			Expect(other.Rmdir("/dir")).To(Succeed())
+			Expect(other.Mkdir("/dir")).To(Succeed())
+			_, err := other.WriteFile("/dir/baz.txt", []byte("baz"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(func() []string {
+				return names("/dir")
+			}).Should(ConsistOf("baz.txt"))
+			b, err := ft.ReadFile("/dir/baz.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(Equal([]byte("baz")))
+		})
+
+		It("forgets directories that aren't looked up anymore", func() {
+			for i := 0; i < 10; i++ {
+				dir := fmt.Sprintf("/dir/sub%d", i)
+				Expect(ft.Mkdir(dir)).To(Succeed())
+				Expect(names(dir)).To(BeEmpty())
+			}
+			Expect(ft.DirStates()).To(BeNumerically(">=", 10))
+
+			Eventually(func() int {
+				Expect(names("/dir")).To(HaveLen(11))
+				return ft.DirStates()
+			}).Should(BeNumerically("<=", 2))
+		})
+
+		It("notices directories removed by another client", func() {
+			Expect(other.Remove("/dir/foo.txt")).To(Succeed())
+			Expect(other.Rmdir("/dir")).To(Succeed())
+
+			Eventually(func() bool {
+				_, err := ft.Stat("/dir/foo.txt")
+				return errors.Is(err, os.ErrNotExist)
+			}).Should(BeTrue())
+		})
+
+		It("reads the whole file after another client changed it", func() {
+			opts := filetree.DefaultOptions()
+			opts.RevalidateInterval = time.Hour
+			ft = initFileTreeWithOptions(fake, opts)
+			Expect(names("/dir")).To(ConsistOf("foo.txt"))
+
+			_, err := other.WriteFile("/dir/foo.txt", []byte("longer contents"))
+			Expect(err).NotTo(HaveOccurred())
+			b, err := ft.ReadFile("/dir/foo.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(Equal([]byte("longer contents")))
+		})
+
+		Context("when revalidation is turned off", func() {
+			BeforeEach(func() {
+				opts := filetree.DefaultOptions()
+				opts.RevalidateInterval = 0
+				ft = initFileTreeWithOptions(fake, opts)
+				Expect(names("/dir")).To(ConsistOf("foo.txt"))
+			})
+
+			It("never notices changes made by other clients", func() {
+				_, err := other.WriteFile("/dir/bar.txt", []byte("bar"))
+				Expect(err).NotTo(HaveOccurred())
+				Consistently(func() []string {
+					return names("/dir")
+				}, 100*time.Millisecond).Should(ConsistOf("foo.txt"))
+			})
+		})
+	})
+
+	Describe("ReadFile", func() {
+		It("returns a not exist error when the file doesn't exist", func() {
+			_, err := ft.ReadFile("/nonexistent")
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		})
+	})
+
+	Describe("Close", func() {
+		It("stops making requests to the backend", func() {
+			ft.Close()
+			readDirCalls := fake.ReadDirCallCount()
+
+			_, err := ft.ReadDir("/")
+			Expect(err).To(MatchError(ContainSubstring(requester.ErrStopped.Error())))
+			Expect(fake.ReadDirCallCount()).To(Equal(readDirCalls))
+		})
+	})
+})
@@ -0,0 +1,323 @@
+// Package filetreetest builds gocryptfs volumes in memory, so that a FileTree
+// and everything on top of it can be tested against real ciphertext without a
+// remote.
+package filetreetest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+	"github.com/flawedmatrix/gocryptsftp/filetree/filetreefakes"
+)
+
+// MemFS is a simple in-memory filesystem that implements
+// filetree.FSAccessor. Paths are absolute and slash-separated.
+type MemFS struct {
+	lock  sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+	// changes counts the entries added to or removed from each directory,
+	// and is used as its mtime.
+	changes map[string]int64
+	// open counts the files that are open, and read the bytes read from
+	// them.
+	open int
+	read int64
+}
+
+// NewMemFS creates a MemFS holding only the root directory.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files:   map[string][]byte{},
+		dirs:    map[string]bool{"/": true},
+		changes: map[string]int64{},
+	}
+}
+
+// fileInfo describes an entry of a MemFS.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() os.FileMode  { return i.mode }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *fileInfo) Sys() interface{}   { return nil }
+
+func (m *MemFS) fileInfo(path string) os.FileInfo {
+	info := &fileInfo{
+		name:    filepath.Base(path),
+		modTime: time.Unix(1500000000+m.changes[path], 0),
+	}
+	if m.dirs[path] {
+		info.mode = os.ModeDir | 0755
+	} else {
+		info.size = int64(len(m.files[path]))
+		info.mode = 0644
+	}
+	return info
+}
+
+func notExist(op, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: syscall.ENOENT}
+}
+
+// ReadFile returns a copy of the contents of the file at path.
+func (m *MemFS) ReadFile(path string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	b, found := m.files[path]
+	if !found {
+		return nil, notExist("open", path)
+	}
+	return append([]byte{}, b...), nil
+}
+
+// Open opens the file at path. Reads from it see its contents at the time
+// of the read.
+func (m *MemFS) Open(path string) (filetree.File, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, found := m.files[path]; !found {
+		return nil, notExist("open", path)
+	}
+	m.open++
+	return &memFile{m: m, path: path}, nil
+}
+
+// memFile is a file of a MemFS opened with Open.
+type memFile struct {
+	m      *MemFS
+	path   string
+	closed bool
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.m.lock.Lock()
+	defer f.m.lock.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	b, found := f.m.files[f.path]
+	if !found {
+		return 0, notExist("read", f.path)
+	}
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b[off:])
+	f.m.read += int64(n)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Close() error {
+	f.m.lock.Lock()
+	defer f.m.lock.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	f.m.open--
+	return nil
+}
+
+// OpenFiles returns the number of files that were opened and not closed yet.
+func (m *MemFS) OpenFiles() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.open
+}
+
+// BytesRead returns the number of bytes read from opened files so far.
+func (m *MemFS) BytesRead() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.read
+}
+
+// Stat returns the file info of the file or directory at path.
+func (m *MemFS) Stat(path string) (os.FileInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, found := m.files[path]; !found && !m.dirs[path] {
+		return nil, notExist("stat", path)
+	}
+	return m.fileInfo(path), nil
+}
+
+// ReadDir lists the directory at path, sorted by name.
+func (m *MemFS) ReadDir(path string) ([]os.FileInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.dirs[path] {
+		return nil, notExist("open", path)
+	}
+	var names []string
+	for p := range m.files {
+		if filepath.Dir(p) == path {
+			names = append(names, p)
+		}
+	}
+	for p := range m.dirs {
+		if p != "/" && filepath.Dir(p) == path {
+			names = append(names, p)
+		}
+	}
+	sort.Strings(names)
+	var listing []os.FileInfo
+	for _, p := range names {
+		listing = append(listing, m.fileInfo(p))
+	}
+	return listing, nil
+}
+
+// WriteFile stores a copy of data as the contents of the file at path. The
+// file is created if it doesn't exist, but its directory must exist.
+func (m *MemFS) WriteFile(path string, data []byte) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.dirs[filepath.Dir(path)] || m.dirs[path] {
+		return 0, fmt.Errorf("cannot write %s", path)
+	}
+	if _, found := m.files[path]; !found {
+		m.changes[filepath.Dir(path)]++
+	}
+	m.files[path] = append([]byte{}, data...)
+	return int64(len(data)), nil
+}
+
+// Mkdir creates the directory at path. Its parent must exist.
+func (m *MemFS) Mkdir(path string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, isFile := m.files[path]
+	if !m.dirs[filepath.Dir(path)] || m.dirs[path] || isFile {
+		return fmt.Errorf("cannot create directory %s", path)
+	}
+	m.dirs[path] = true
+	m.changes[filepath.Dir(path)]++
+	return nil
+}
+
+// Rename renames the file or directory at path to target, replacing target
+// if it's a file.
+func (m *MemFS) Rename(path string, target string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.dirs[filepath.Dir(target)] || m.dirs[target] {
+		return fmt.Errorf("cannot rename to %s", target)
+	}
+	if _, found := m.files[path]; found || m.dirs[path] {
+		m.changes[filepath.Dir(path)]++
+		m.changes[filepath.Dir(target)]++
+	}
+	if b, found := m.files[path]; found {
+		delete(m.files, path)
+		m.files[target] = b
+		return nil
+	}
+	if !m.dirs[path] {
+		return notExist("rename", path)
+	}
+	for p, b := range m.files {
+		if strings.HasPrefix(p, path+"/") {
+			delete(m.files, p)
+			m.files[target+strings.TrimPrefix(p, path)] = b
+		}
+	}
+	for p := range m.dirs {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			delete(m.dirs, p)
+			m.dirs[target+strings.TrimPrefix(p, path)] = true
+		}
+	}
+	return nil
+}
+
+// Remove removes the file or empty directory at path.
+func (m *MemFS) Remove(path string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, found := m.files[path]; found {
+		delete(m.files, path)
+		m.changes[filepath.Dir(path)]++
+		return nil
+	}
+	if !m.dirs[path] {
+		return notExist("remove", path)
+	}
+	for p := range m.files {
+		if filepath.Dir(p) == path {
+			return fmt.Errorf("directory %s not empty", path)
+		}
+	}
+	for p := range m.dirs {
+		if p != path && filepath.Dir(p) == path {
+			return fmt.Errorf("directory %s not empty", path)
+		}
+	}
+	delete(m.dirs, path)
+	delete(m.changes, path)
+	m.changes[filepath.Dir(path)]++
+	return nil
+}
+
+// MkdirAll creates the directory at path along with any missing parents.
+func (m *MemFS) MkdirAll(path string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for p := path; p != "/"; p = filepath.Dir(p) {
+		m.dirs[p] = true
+	}
+}
+
+// Paths returns all the files and directories stored under the given path,
+// sorted.
+func (m *MemFS) Paths(under string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var paths []string
+	for p := range m.files {
+		if strings.HasPrefix(p, under+"/") {
+			paths = append(paths, p)
+		}
+	}
+	for p := range m.dirs {
+		if strings.HasPrefix(p, under+"/") {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Fake returns a FakeFSAccessor that stores everything in this MemFS, so
+// that tests can also inspect the calls made to it.
+func (m *MemFS) Fake() *filetreefakes.FakeFSAccessor {
+	fake := new(filetreefakes.FakeFSAccessor)
+	fake.ReadFileStub = m.ReadFile
+	fake.OpenStub = m.Open
+	fake.StatStub = m.Stat
+	fake.ReadDirStub = m.ReadDir
+	fake.WriteFileStub = m.WriteFile
+	fake.MkdirStub = m.Mkdir
+	fake.RenameStub = m.Rename
+	fake.RemoveStub = m.Remove
+	return fake
+}
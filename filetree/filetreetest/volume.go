@@ -0,0 +1,236 @@
+package filetreetest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/configfile"
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/contentenc"
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/cryptocore"
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/nametransform"
+)
+
+// Tree is a plaintext tree of files, keyed by their slash-separated paths
+// relative to the root of the volume. Keys ending in "/" are directories,
+// and every other key is a file with the given contents. Parent directories
+// don't need to be listed.
+type Tree map[string]string
+
+// VolumeOptions holds the settings of a generated volume.
+type VolumeOptions struct {
+	// PlaintextNames only encrypts file contents, and leaves the names as
+	// they are.
+	PlaintextNames bool
+	// AESSIV encrypts the contents with AES-SIV instead of AES-GCM.
+	AESSIV bool
+	// ConfPath is the path of an existing gocryptfs.conf on the local
+	// filesystem to use instead of creating one. PlaintextNames and AESSIV
+	// are taken from it then.
+	ConfPath string
+}
+
+// scryptLogN is the cheapest scrypt cost gocryptfs accepts, which keeps
+// creating and opening volumes fast.
+const scryptLogN = 10
+
+// AddVolume creates a gocryptfs volume at root holding the files in tree,
+// encrypted with password. Like gocryptfs, every directory gets a random
+// directory IV, and names that are too long once encrypted are stored in
+// separate long name files.
+func (m *MemFS) AddVolume(root string, password []byte, tree Tree, opts VolumeOptions) error {
+	confBytes, masterKey, conf, err := loadConf(password, opts)
+	if err != nil {
+		return err
+	}
+	cryptoBackend := cryptocore.BackendGoGCM
+	if conf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		cryptoBackend = cryptocore.BackendAESSIV
+	}
+	cCore := cryptocore.New(
+		masterKey, cryptoBackend, contentenc.DefaultIVBits,
+		conf.IsFeatureFlagSet(configfile.FlagHKDF), false,
+	)
+	defer cCore.Wipe()
+	for i := range masterKey {
+		masterKey[i] = 0
+	}
+
+	v := &volume{
+		fs:     m,
+		cEnc:   contentenc.New(cCore, contentenc.DefaultBS, false),
+		cPaths: map[string]string{"/": root},
+		ivs:    map[string][]byte{},
+	}
+	if !conf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		v.longNames = conf.IsFeatureFlagSet(configfile.FlagLongNames)
+		v.nTransform = nametransform.New(cCore.EMECipher, v.longNames, conf.IsFeatureFlagSet(configfile.FlagRaw64))
+	}
+
+	m.MkdirAll(root)
+	if _, err = m.WriteFile(filepath.Join(root, configfile.ConfDefaultName), confBytes); err != nil {
+		return err
+	}
+	if err = v.writeDirIV("/"); err != nil {
+		return err
+	}
+
+	plainPaths := make([]string, 0, len(tree))
+	for p := range tree {
+		plainPaths = append(plainPaths, p)
+	}
+	// Sorting puts every directory before the entries in it.
+	sort.Strings(plainPaths)
+	for _, p := range plainPaths {
+		plainPath := filepath.Clean("/" + p)
+		if plainPath == "/" {
+			return fmt.Errorf("invalid path %q in tree", p)
+		}
+		if err = v.mkdirAll(filepath.Dir(plainPath)); err != nil {
+			return err
+		}
+		if strings.HasSuffix(p, "/") {
+			err = v.mkdirAll(plainPath)
+		} else {
+			err = v.writeFile(plainPath, []byte(tree[p]))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadConf returns the contents of the config of a new volume along with its
+// decrypted master key.
+func loadConf(password []byte, opts VolumeOptions) ([]byte, []byte, *configfile.ConfFile, error) {
+	confPath := opts.ConfPath
+	if confPath == "" {
+		dir, err := ioutil.TempDir("", "filetreetest")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		confPath = filepath.Join(dir, configfile.ConfDefaultName)
+		err = configfile.Create(confPath, password, opts.PlaintextNames, scryptLogN, "filetreetest", opts.AESSIV, false, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	confBytes, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	masterKey, conf, err := configfile.LoadAndDecrypt(confPath, password)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return confBytes, masterKey, conf, nil
+}
+
+// volume encrypts a plaintext tree into a MemFS.
+type volume struct {
+	fs *MemFS
+
+	cEnc *contentenc.ContentEnc
+	// nTransform is nil for volumes with plaintext names.
+	nTransform *nametransform.NameTransform
+	longNames  bool
+
+	// cPaths maps the plaintext paths of the directories created so far to
+	// their paths in fs.
+	cPaths map[string]string
+	ivs    map[string][]byte
+}
+
+// mkdirAll creates the directory at plainPath along with any missing
+// parents.
+func (v *volume) mkdirAll(plainPath string) error {
+	if _, found := v.cPaths[plainPath]; found {
+		return nil
+	}
+	if err := v.mkdirAll(filepath.Dir(plainPath)); err != nil {
+		return err
+	}
+	cPath, err := v.cipherPath(plainPath)
+	if err != nil {
+		return err
+	}
+	if err = v.fs.Mkdir(cPath); err != nil {
+		return err
+	}
+	v.cPaths[plainPath] = cPath
+	return v.writeDirIV(plainPath)
+}
+
+// writeDirIV gives the directory at plainPath a random directory IV.
+func (v *volume) writeDirIV(plainPath string) error {
+	if v.nTransform == nil {
+		return nil
+	}
+	iv := cryptocore.RandBytes(nametransform.DirIVLen)
+	v.ivs[plainPath] = iv
+	_, err := v.fs.WriteFile(filepath.Join(v.cPaths[plainPath], nametransform.DirIVFilename), iv)
+	return err
+}
+
+// writeFile encrypts data and stores it as the file at plainPath. Its
+// directory must already exist.
+func (v *volume) writeFile(plainPath string, data []byte) error {
+	cPath, err := v.cipherPath(plainPath)
+	if err != nil {
+		return err
+	}
+	_, err = v.fs.WriteFile(cPath, v.encrypt(data))
+	return err
+}
+
+// cipherPath returns the path in fs of the entry at plainPath, whose
+// directory must already exist. It writes the long name file of the entry if
+// it needs one.
+func (v *volume) cipherPath(plainPath string) (string, error) {
+	plainDir, plainName := filepath.Split(plainPath)
+	plainDir = filepath.Clean(plainDir)
+	cDir := v.cPaths[plainDir]
+	if v.nTransform == nil {
+		return filepath.Join(cDir, plainName), nil
+	}
+	if len(plainName) > nametransform.NameMax {
+		return "", fmt.Errorf("name %s is too long", plainName)
+	}
+	cName := v.nTransform.EncryptName(plainName, v.ivs[plainDir])
+	if len(cName) <= nametransform.NameMax {
+		return filepath.Join(cDir, cName), nil
+	}
+	if !v.longNames {
+		return "", fmt.Errorf("name %s is too long once encrypted", plainName)
+	}
+	cPath := filepath.Join(cDir, v.nTransform.HashLongName(cName))
+	_, err := v.fs.WriteFile(cPath+nametransform.LongNameSuffix, []byte(cName))
+	return cPath, err
+}
+
+// encrypt encrypts plainBytes into the gocryptfs on-disk format: a file
+// header with a random file ID, followed by the encrypted blocks. Empty files
+// stay empty. Speed doesn't matter for fixtures, so each block is encrypted
+// on its own.
+func (v *volume) encrypt(plainBytes []byte) []byte {
+	if len(plainBytes) == 0 {
+		return []byte{}
+	}
+	header := contentenc.RandomHeader()
+	cipherBytes := header.Pack()
+	plainBS := int(v.cEnc.PlainBS())
+	for blockNo := 0; blockNo*plainBS < len(plainBytes); blockNo++ {
+		block := plainBytes[blockNo*plainBS:]
+		if len(block) > plainBS {
+			block = block[:plainBS]
+		}
+		cipherBytes = append(cipherBytes, v.cEnc.EncryptBlock(block, uint64(blockNo), header.ID)...)
+	}
+	return cipherBytes
+}
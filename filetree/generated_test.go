@@ -0,0 +1,135 @@
+package filetree_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+	"github.com/flawedmatrix/gocryptsftp/filetree/filetreetest"
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/nametransform"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("a volume generated from a plaintext tree", func() {
+	var (
+		mfs      *filetreetest.MemFS
+		opts     filetreetest.VolumeOptions
+		longName string
+		bigFile  string
+		ft       *filetree.FileTree
+	)
+
+	BeforeEach(func() {
+		mfs = filetreetest.NewMemFS()
+		opts = filetreetest.VolumeOptions{}
+		// Long enough for the encrypted name to exceed 255 bytes
+		longName = strings.Repeat("x", 200)
+		// Spans several blocks, with a partial last block
+		bigFile = string(bytes.Repeat([]byte("0123456789"), 30000))
+	})
+
+	JustBeforeEach(func() {
+		newEncryptedRoot(mfs, filetreetest.Tree{
+			"a.txt":                   "a",
+			"empty.txt":               "",
+			"photos/2020/big.bin":     bigFile,
+			"photos/2020/" + longName: "long",
+			longName + "/nested.txt":  "nested",
+			"photos/empty-dir/":       "",
+		}, opts)
+		ft = initFileTree(mfs)
+	})
+
+	AfterEach(func() {
+		ft.Close()
+	})
+
+	readDirNames := func(path string) []string {
+		infos, err := ft.ReadDir(path)
+		ExpectWithOffset(1, err).NotTo(HaveOccurred())
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+
+	It("decrypts the whole tree", func() {
+		Expect(readDirNames("/")).To(ConsistOf("a.txt", "empty.txt", "photos", longName))
+		Expect(readDirNames("/photos")).To(ConsistOf("2020", "empty-dir"))
+		Expect(readDirNames("/photos/2020")).To(ConsistOf("big.bin", longName))
+		Expect(readDirNames("/photos/empty-dir")).To(BeEmpty())
+
+		Expect(ft.ReadFile("/a.txt")).To(Equal([]byte("a")))
+		Expect(ft.ReadFile("/empty.txt")).To(BeEmpty())
+		Expect(ft.ReadFile("/photos/2020/big.bin")).To(Equal([]byte(bigFile)))
+		Expect(ft.ReadFile("/photos/2020/" + longName)).To(Equal([]byte("long")))
+		Expect(ft.ReadFile("/" + longName + "/nested.txt")).To(Equal([]byte("nested")))
+
+		info, err := ft.Stat("/photos/2020/big.bin")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size()).To(BeEquivalentTo(len(bigFile)))
+	})
+
+	It("stores it like gocryptfs", func() {
+		var longNames, dirIVs int
+		for _, p := range mfs.Paths(testEncryptedRoot) {
+			name := filepath.Base(p)
+			Expect(name).NotTo(ContainSubstring("photos"))
+			switch {
+			case name == nametransform.DirIVFilename:
+				dirIVs++
+			case nametransform.NameType(name) == nametransform.LongNameFilename:
+				longNames++
+			}
+		}
+		Expect(dirIVs).To(Equal(5))
+		Expect(longNames).To(Equal(2))
+	})
+
+	It("can be changed through the FileTree", func() {
+		_, err := ft.WriteFile("/photos/2020/new.txt", []byte("new"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ft.Rename("/a.txt", "/photos/a.txt")).To(Succeed())
+
+		other := initFileTree(mfs)
+		defer other.Close()
+		Expect(other.ReadFile("/photos/2020/new.txt")).To(Equal([]byte("new")))
+		Expect(other.ReadFile("/photos/a.txt")).To(Equal([]byte("a")))
+	})
+
+	It("fails for names that are too long", func() {
+		err := filetreetest.NewMemFS().AddVolume("/root", []byte(testPassword), filetreetest.Tree{
+			strings.Repeat("x", 256): "",
+		}, filetreetest.VolumeOptions{})
+		Expect(err).To(MatchError(ContainSubstring("too long")))
+	})
+
+	Context("with plaintext names", func() {
+		BeforeEach(func() {
+			opts.PlaintextNames = true
+		})
+
+		It("only encrypts the contents", func() {
+			Expect(readDirNames("/photos/2020")).To(ConsistOf("big.bin", longName))
+			Expect(ft.ReadFile("/photos/2020/big.bin")).To(Equal([]byte(bigFile)))
+
+			ciphertext, err := mfs.ReadFile(filepath.Join(testEncryptedRoot, "a.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ciphertext).NotTo(Equal([]byte("a")))
+		})
+	})
+
+	Context("with AES-SIV content encryption", func() {
+		BeforeEach(func() {
+			opts.AESSIV = true
+		})
+
+		It("decrypts the files", func() {
+			Expect(ft.ReadFile("/photos/2020/big.bin")).To(Equal([]byte(bigFile)))
+			Expect(ft.ReadFile("/" + longName + "/nested.txt")).To(Equal([]byte("nested")))
+		})
+	})
+})
@@ -0,0 +1,29 @@
+package filetree_test
+
+import (
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+	"github.com/flawedmatrix/gocryptsftp/filetree/filetreetest"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	testEncryptedRoot = "/encrypted/root"
+	testPassword      = "test"
+)
+
+// newEncryptedRoot creates a gocryptfs filesystem at testEncryptedRoot in
+// mfs holding the files in tree.
+func newEncryptedRoot(mfs *filetreetest.MemFS, tree filetreetest.Tree, opts filetreetest.VolumeOptions) {
+	err := mfs.AddVolume(testEncryptedRoot, []byte(testPassword), tree, opts)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+}
+
+func initFileTree(fsAccessor filetree.FSAccessor) *filetree.FileTree {
+	return initFileTreeWithOptions(fsAccessor, filetree.DefaultOptions())
+}
+
+func initFileTreeWithOptions(fsAccessor filetree.FSAccessor, opts filetree.Options) *filetree.FileTree {
+	ft, err := filetree.Init(testEncryptedRoot, []byte(testPassword), 4, fsAccessor, opts)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	return ft
+}
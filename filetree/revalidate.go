@@ -0,0 +1,127 @@
+package filetree
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/nametransform"
+)
+
+// dirState is what a directory on the backend looked like the last time it
+// was checked.
+type dirState struct {
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// dirStateLifetime is the number of revalidation intervals after which the
+// state of a directory that wasn't looked up again is dropped. A directory
+// whose state was dropped has its cached contents purged when it's next
+// looked up, as if it had never been checked.
+const dirStateLifetime = 4
+
+// dirStates keeps track of the state of the directories on the backend, so
+// that changes made by other clients can be noticed.
+type dirStates struct {
+	lock   sync.Mutex
+	states map[string]dirState
+	// pruned is when the states were last pruned.
+	pruned time.Time
+}
+
+// prune drops the states that weren't checked within the last
+// dirStateLifetime intervals, so that the states of directories that aren't
+// used anymore don't pile up. It only goes through the states once per
+// interval. The lock must be held.
+func (d *dirStates) prune(now time.Time, interval time.Duration) {
+	if now.Sub(d.pruned) < interval {
+		return
+	}
+	d.pruned = now
+	for cipherPath, state := range d.states {
+		if now.Sub(state.checked) >= dirStateLifetime*interval {
+			delete(d.states, cipherPath)
+		}
+	}
+}
+
+// revalidate checks whether the directory at cipherPath changed on the
+// backend since it was last checked, and purges everything cached about its
+// contents if it did. Directories are checked at most once per
+// RevalidateInterval.
+func (f *FileTree) revalidate(cipherPath string) {
+	if f.revalidateInterval <= 0 {
+		return
+	}
+	now := time.Now()
+	f.dirStates.lock.Lock()
+	f.dirStates.prune(now, f.revalidateInterval)
+	old, known := f.dirStates.states[cipherPath]
+	if known && now.Sub(old.checked) < f.revalidateInterval {
+		f.dirStates.lock.Unlock()
+		return
+	}
+	// Claim this check so that concurrent lookups keep using the cache
+	// instead of all checking the same directory.
+	claimed := old
+	claimed.checked = now
+	f.dirStates.states[cipherPath] = claimed
+	f.dirStates.lock.Unlock()
+
+	info, err := f.fsAccessor.Stat(cipherPath)
+	if err != nil {
+		// The directory may have been removed or renamed. Forget about it
+		// so that the lookup in progress fails and the next one starts
+		// from scratch.
+		f.forgetDir(cipherPath)
+		f.purgeDir(cipherPath)
+		return
+	}
+
+	f.dirStates.lock.Lock()
+	f.dirStates.states[cipherPath] = dirState{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		checked: now,
+	}
+	f.dirStates.lock.Unlock()
+
+	// Anything cached before the directory was first checked can't be
+	// trusted, since it's unknown what the directory looked like then.
+	if !known || !info.ModTime().Equal(old.modTime) || info.Size() != old.size {
+		f.purgeDir(cipherPath)
+	}
+}
+
+// forgetDir drops the recorded state of the directory at cipherPath.
+func (f *FileTree) forgetDir(cipherPath string) {
+	if f.revalidateInterval <= 0 {
+		return
+	}
+	f.dirStates.lock.Lock()
+	delete(f.dirStates.states, cipherPath)
+	f.dirStates.lock.Unlock()
+}
+
+// purgeDir purges the cached listing of the directory at cipherPath, along
+// with its directory IV, its long name files, the names decrypted with its
+// old directory IV and the locations of the directory and of the directories
+// under it.
+func (f *FileTree) purgeDir(cipherPath string) {
+	var oldIV []byte
+	if !f.plaintextNames {
+		oldIV, _ = f.reqCacher.CachedFile(filepath.Join(cipherPath, nametransform.DirIVFilename))
+	}
+	f.reqCacher.ClearDir(cipherPath)
+	f.reqCacher.ClearFilesIn(cipherPath)
+	f.fastCache.DeleteCiphertext(cipherPath)
+	if oldIV == nil {
+		return
+	}
+	if newIV, err := f.dirIV(cipherPath); err != nil || !bytes.Equal(oldIV, newIV) {
+		f.reqCacher.ClearNames(oldIV)
+	}
+}
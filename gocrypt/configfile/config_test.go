@@ -52,6 +52,16 @@ func TestLoadV2Feature(t *testing.T) {
 	}
 }
 
+func TestLoadV2AESSIV(t *testing.T) {
+	_, c, err := LoadAndDecrypt("config_test/AESSIV.conf", testPw)
+	if err != nil {
+		t.Fatalf("Could not load v2 AESSIV config file: %v", err)
+	}
+	if !c.IsFeatureFlagSet(FlagAESSIV) {
+		t.Error("AESSIV flag should be set but is not")
+	}
+}
+
 func TestLoadV2StrangeFeature(t *testing.T) {
 	_, _, err := LoadAndDecrypt("config_test/StrangeFeature.conf", testPw)
 	if err == nil {
@@ -1,27 +1,22 @@
 package handlers
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"syscall"
 
 	"github.com/flawedmatrix/gocryptsftp/filetree"
 	"github.com/pkg/sftp"
 )
 
-func DecryptHandler(encryptedRoot string, password []byte, numWorkers int, fsAccessor filetree.FSAccessor) (sftp.Handlers, error) {
-	ft, err := filetree.Init(encryptedRoot, password, numWorkers, fsAccessor)
+func DecryptHandler(encryptedRoot string, password []byte, numWorkers int, fsAccessor filetree.FSAccessor, opts filetree.Options) (sftp.Handlers, error) {
+	v, err := NewVolume("", encryptedRoot, password, numWorkers, fsAccessor, opts)
 	if err != nil {
 		return sftp.Handlers{}, err
 	}
-	h := &decrypt{ft: ft}
-	return sftp.Handlers{
-		FileGet:  h,
-		FilePut:  h,
-		FileCmd:  h,
-		FileList: h,
-	}, nil
+	return v.Handlers(), nil
 }
 
 type decrypt struct {
@@ -29,51 +24,123 @@ type decrypt struct {
 }
 
 func (p *decrypt) Fileread(req *sftp.Request) (io.ReaderAt, error) {
-	b, err := p.ft.ReadFile(req.Filepath)
-	if err != nil {
-		return nil, err
-	}
-	return bytes.NewReader(b), nil
+	r, err := p.fileread(req.Filepath)
+	return r, clientError(req.Method, req.Filepath, err)
 }
 
 func (p *decrypt) Filewrite(req *sftp.Request) (io.WriterAt, error) {
-	return nil, fmt.Errorf("Writing not supported for path: %s", req.Filepath)
+	w, err := p.filewrite(req.Filepath, req.Pflags())
+	return w, clientError(req.Method, req.Filepath, err)
 }
 
 func (p *decrypt) Filecmd(req *sftp.Request) error {
-	switch req.Method {
+	err := p.filecmd(req.Method, req.Filepath, req.Target)
+	return clientError(req.Method, req.Filepath, err)
+}
+
+// PosixRename handles renames made with the posix-rename@openssh.com
+// extension, which replace the target if it exists.
+func (p *decrypt) PosixRename(req *sftp.Request) error {
+	err := p.ft.PosixRename(req.Filepath, req.Target)
+	return clientError(req.Method, req.Filepath, err)
+}
+
+func (p *decrypt) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	l, err := p.filelist(req.Method, req.Filepath)
+	return l, clientError(req.Method, req.Filepath, err)
+}
+
+// clientError turns errors about missing files, denied permissions or
+// existing files into the errors sftp reports to clients with a matching
+// status, since it doesn't look into wrapped errors. Other errors are returned as they are.
+func clientError(op, path string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrNotExist):
+		return &os.PathError{Op: op, Path: path, Err: syscall.ENOENT}
+	case errors.Is(err, os.ErrPermission):
+		return permissionDenied(op, path)
+	case errors.Is(err, os.ErrExist):
+		return &os.PathError{Op: op, Path: path, Err: syscall.EEXIST}
+	}
+	return err
+}
+
+func (p *decrypt) fileread(path string) (io.ReaderAt, error) {
+	return p.ft.Open(path)
+}
+
+func (p *decrypt) filewrite(path string, flags sftp.FileOpenFlags) (io.WriterAt, error) {
+	w := &writerat{ft: p.ft, path: path, maxSize: p.ft.MaxFileSize()}
+	if flags.Excl {
+		if _, err := p.ft.Stat(path); err == nil {
+			return nil, fmt.Errorf("File already exists. path: %s: %w", path, os.ErrExist)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if flags.Trunc {
+		return w, nil
+	}
+	// Writes to an existing file that isn't truncated need to keep its
+	// current contents, as long as they fit in the limit.
+	info, err := p.ft.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return w, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if info.Size() > w.maxSize {
+		return nil, fmt.Errorf("File is larger than the limit of %d bytes. path: %s", w.maxSize, path)
+	}
+	b, err := p.ft.ReadFile(path)
+	if err == nil {
+		w.buf = b
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (p *decrypt) filecmd(method, path, target string) error {
+	switch method {
 	case "Setstat":
 		// Probably will never support
-		return fmt.Errorf("Setstat not supported. path: %s", req.Filepath)
+		return fmt.Errorf("Setstat not supported. path: %s", path)
 	case "Rename":
-		return fmt.Errorf("Renaming not supported. path: %s, target: %s", req.Filepath, req.Target)
-	case "Rmdir", "Remove":
-		return fmt.Errorf("Removing not supported. path: %s", req.Filepath)
+		return p.ft.Rename(path, target)
+	case "Rmdir":
+		return p.ft.Rmdir(path)
+	case "Remove":
+		return p.ft.Remove(path)
 	case "Mkdir":
-		return fmt.Errorf("Mkdir not supported. path: %s", req.Filepath)
+		return p.ft.Mkdir(path)
 	case "Symlink":
 		// Probably will never support
-		return fmt.Errorf("Symlink not supported. path: %s, target %s", req.Filepath, req.Target)
+		return fmt.Errorf("Symlink not supported. path: %s, target %s", path, target)
 	}
-	return nil
+	// Anything else, such as hard links made with the hardlink@openssh.com
+	// extension, must not be reported as done.
+	return sftp.ErrSSHFxOpUnsupported
 }
 
-func (p *decrypt) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
-	switch req.Method {
+func (p *decrypt) filelist(method, path string) (sftp.ListerAt, error) {
+	switch method {
 	case "List":
-		fileList, err := p.ft.ReadDir(req.Filepath)
+		fileList, err := p.ft.ReadDir(path)
 		if err != nil {
 			return nil, err
 		}
 		return listerat(fileList), nil
 	case "Stat":
-		fileInfo, err := p.ft.Stat(req.Filepath)
+		fileInfo, err := p.ft.Stat(path)
 		if err != nil {
 			return nil, err
 		}
 		return listerat([]os.FileInfo{fileInfo}), nil
 	case "Readlink":
-		return nil, fmt.Errorf("ReadLink not supported. path: %s", req.Filepath)
+		return nil, fmt.Errorf("ReadLink not supported. path: %s", path)
 	}
 	return nil, nil
 }
@@ -0,0 +1,167 @@
+package handlers_test
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+	"github.com/flawedmatrix/gocryptsftp/filetree/filetreetest"
+	"github.com/flawedmatrix/gocryptsftp/handlers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/sftp"
+)
+
+var _ = Describe("DecryptHandler", func() {
+	var (
+		longName string
+		mfs      *filetreetest.MemFS
+		handler  sftp.Handlers
+	)
+
+	BeforeEach(func() {
+		// Long enough for the encrypted name to exceed 255 bytes
+		longName = strings.Repeat("x", 200)
+		mfs = filetreetest.NewMemFS()
+		err := mfs.AddVolume("/encrypted", []byte(testPassword), filetreetest.Tree{
+			"docs/a.txt":            "a",
+			"docs/" + longName:      "long",
+			"photos/2020/photo.jpg": "photo",
+		}, filetreetest.VolumeOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		opts := filetree.DefaultOptions()
+		opts.MaxFileSize = 16
+		handler, err = handlers.DecryptHandler("/encrypted", []byte(testPassword), 2, mfs, opts)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("serves the decrypted files of a volume", func() {
+		infos, err := list(handler, "List", "/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(infos)).To(ConsistOf("docs", "photos"))
+
+		infos, err = list(handler, "List", "/docs")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(infos)).To(ConsistOf("a.txt", longName))
+
+		Expect(readFile(handler, "/docs/"+longName)).To(Equal("long"))
+		Expect(readFile(handler, "/photos/2020/photo.jpg")).To(Equal("photo"))
+	})
+
+	It("writes files that can be read back", func() {
+		Expect(writeFile(handler, "/photos/2020/new.txt", "new")).To(Succeed())
+		Expect(readFile(handler, "/photos/2020/new.txt")).To(Equal("new"))
+	})
+
+	It("rejects hard links instead of pretending to make them", func() {
+		req := sftp.NewRequest("Link", "/docs/link.txt")
+		req.Target = "/docs/a.txt"
+		Expect(handler.FileCmd.Filecmd(req)).To(Equal(sftp.ErrSSHFxOpUnsupported))
+		_, err := list(handler, "Stat", "/docs/link.txt")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	Describe("writing", func() {
+		// The SSH_FXF_* open flags from the SFTP spec.
+		const (
+			flagWrite = 0x02
+			flagCreat = 0x08
+			flagTrunc = 0x10
+			flagExcl  = 0x20
+		)
+
+		open := func(path string, flags uint32) (io.WriterAt, error) {
+			req := sftp.NewRequest("Put", path)
+			req.Flags = flags
+			return handler.FilePut.Filewrite(req)
+		}
+
+		It("refuses to replace an existing file when opened exclusively", func() {
+			_, err := open("/docs/a.txt", flagWrite|flagCreat|flagTrunc|flagExcl)
+			Expect(errors.Is(err, syscall.EEXIST)).To(BeTrue())
+			Expect(readFile(handler, "/docs/a.txt")).To(Equal("a"))
+
+			w, err := open("/docs/b.txt", flagWrite|flagCreat|flagTrunc|flagExcl)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.WriteAt([]byte("b"), 0)).To(Equal(1))
+			Expect(w.(io.Closer).Close()).To(Succeed())
+			Expect(readFile(handler, "/docs/b.txt")).To(Equal("b"))
+		})
+
+		It("rejects negative offsets", func() {
+			w, err := open("/docs/a.txt", flagWrite|flagTrunc)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = w.WriteAt([]byte("b"), -1)
+			Expect(err).To(HaveOccurred())
+			Expect(w.(io.Closer).Close()).NotTo(Succeed())
+			Expect(readFile(handler, "/docs/a.txt")).To(Equal("a"))
+		})
+
+		It("rejects files larger than the limit", func() {
+			w, err := open("/docs/a.txt", flagWrite|flagTrunc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.WriteAt([]byte("0123456789"), 0)).To(Equal(10))
+			_, err = w.WriteAt([]byte("0123456789"), 10)
+			Expect(err).To(HaveOccurred())
+			_, err = w.WriteAt([]byte("x"), math.MaxInt64)
+			Expect(err).To(HaveOccurred())
+			Expect(w.(io.Closer).Close()).NotTo(Succeed())
+			Expect(readFile(handler, "/docs/a.txt")).To(Equal("a"))
+		})
+
+		It("refuses to open files larger than the limit without truncating them", func() {
+			Expect(writeFile(handler, "/docs/big.txt", "0123456789abcdef")).To(Succeed())
+			w, err := open("/docs/big.txt", flagWrite)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.(io.Closer).Close()).To(Succeed())
+
+			opts := filetree.DefaultOptions()
+			opts.MaxFileSize = 8
+			handler, err = handlers.DecryptHandler("/encrypted", []byte(testPassword), 2, mfs, opts)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = open("/docs/big.txt", flagWrite)
+			Expect(err).To(MatchError(ContainSubstring("larger than the limit")))
+			_, err = open("/docs/big.txt", flagWrite|flagTrunc)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Context("when there's no configured limit", func() {
+			BeforeEach(func() {
+				mfs := filetreetest.NewMemFS()
+				err := mfs.AddVolume("/encrypted", []byte(testPassword), filetreetest.Tree{
+					"docs/a.txt": "a",
+				}, filetreetest.VolumeOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				opts := filetree.DefaultOptions()
+				opts.MaxFileSize = 0
+				handler, err = handlers.DecryptHandler("/encrypted", []byte(testPassword), 2, mfs, opts)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("rejects writes at huge offsets instead of allocating for them", func() {
+				w, err := open("/docs/a.txt", flagWrite|flagTrunc)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = w.WriteAt([]byte("x"), 1<<62)
+				Expect(err).To(HaveOccurred())
+				_, err = w.WriteAt([]byte("x"), 1<<40)
+				Expect(err).To(HaveOccurred())
+				Expect(w.(io.Closer).Close()).NotTo(Succeed())
+				Expect(readFile(handler, "/docs/a.txt")).To(Equal("a"))
+			})
+		})
+
+		It("leaves the file alone when the transfer fails", func() {
+			w, err := open("/docs/a.txt", flagWrite|flagTrunc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.WriteAt([]byte("partial"), 0)).To(Equal(7))
+			w.(sftp.TransferError).TransferError(io.ErrUnexpectedEOF)
+			Expect(w.(io.Closer).Close()).NotTo(Succeed())
+			Expect(readFile(handler, "/docs/a.txt")).To(Equal("a"))
+		})
+	})
+})
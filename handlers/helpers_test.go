@@ -0,0 +1,53 @@
+package handlers_test
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/sftp"
+)
+
+func list(h sftp.Handlers, method, path string) ([]os.FileInfo, error) {
+	lister, err := h.FileList.Filelist(sftp.NewRequest(method, path))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 10)
+	n, err := lister.ListAt(infos, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return infos[:n], nil
+}
+
+func writeFile(h sftp.Handlers, path string, data string) error {
+	w, err := h.FilePut.Filewrite(sftp.NewRequest("Put", path))
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteAt([]byte(data), 0); err != nil {
+		return err
+	}
+	return w.(io.Closer).Close()
+}
+
+func readFile(h sftp.Handlers, path string) (string, error) {
+	r, err := h.FileGet.Fileread(sftp.NewRequest("Get", path))
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 100)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+func names(infos []os.FileInfo) []string {
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
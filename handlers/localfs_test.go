@@ -0,0 +1,25 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/configfile"
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/cryptocore"
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/nametransform"
+	. "github.com/onsi/gomega"
+)
+
+const testPassword = "test"
+
+// newLocalRoot creates an empty gocryptfs filesystem in a temporary
+// directory, and returns its path.
+func newLocalRoot() string {
+	dir, err := ioutil.TempDir("", "handlers-test")
+	Expect(err).NotTo(HaveOccurred())
+	err = configfile.Create(filepath.Join(dir, configfile.ConfDefaultName), []byte(testPassword), false, 10, "test", false, false, nil)
+	Expect(err).NotTo(HaveOccurred())
+	iv := cryptocore.RandBytes(nametransform.DirIVLen)
+	Expect(ioutil.WriteFile(filepath.Join(dir, nametransform.DirIVFilename), iv, 0644)).To(Succeed())
+	return dir
+}
@@ -55,7 +55,7 @@ func (p *proxy) Filecmd(req *sftp.Request) error {
 	case "Symlink":
 		return fmt.Errorf("Symlink not supported. path: %s, target %s", req.Filepath, req.Target)
 	}
-	return nil
+	return sftp.ErrSSHFxOpUnsupported
 }
 
 type listerat []os.FileInfo
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/sftp"
+)
+
+// Access is the part of the served files a proxy user may access.
+type Access struct {
+	// Root is the directory the user is confined to, which the user sees as
+	// the root.
+	Root string
+	// ReadOnly denies every request that would change a file.
+	ReadOnly bool
+}
+
+// RestrictedHandler serves the files under access.Root of h as the root, and
+// denies everything access doesn't allow. Paths that lead outside of the root
+// are denied as well.
+func RestrictedHandler(h sftp.Handlers, access Access) sftp.Handlers {
+	access.Root = path.Clean("/" + access.Root)
+	r := &restricted{h: h, access: access}
+	return sftp.Handlers{
+		FileGet:  r,
+		FilePut:  r,
+		FileCmd:  r,
+		FileList: r,
+	}
+}
+
+type restricted struct {
+	h      sftp.Handlers
+	access Access
+}
+
+// resolve returns the path of p, which is relative to the root of the user,
+// in h.
+func (r *restricted) resolve(op string, p string) (string, error) {
+	resolved := path.Join(r.access.Root, p)
+	if r.access.Root != "/" && resolved != r.access.Root && !strings.HasPrefix(resolved, r.access.Root+"/") {
+		return "", permissionDenied(op, p)
+	}
+	return resolved, nil
+}
+
+// request returns a copy of req with its paths resolved, for passing on to
+// h. It fails if req changes files but access is read-only.
+func (r *restricted) request(req *sftp.Request, changes bool) (*sftp.Request, error) {
+	op := strings.ToLower(req.Method)
+	if changes && r.access.ReadOnly {
+		return nil, permissionDenied(op, req.Filepath)
+	}
+	resolved := *req
+	var err error
+	if resolved.Filepath, err = r.resolve(op, req.Filepath); err != nil {
+		return nil, err
+	}
+	if req.Target != "" {
+		if resolved.Target, err = r.resolve(op, req.Target); err != nil {
+			return nil, err
+		}
+	}
+	return &resolved, nil
+}
+
+func (r *restricted) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	resolved, err := r.request(req, false)
+	if err != nil {
+		return nil, err
+	}
+	return r.h.FileGet.Fileread(resolved)
+}
+
+func (r *restricted) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	resolved, err := r.request(req, true)
+	if err != nil {
+		return nil, err
+	}
+	return r.h.FilePut.Filewrite(resolved)
+}
+
+func (r *restricted) Filecmd(req *sftp.Request) error {
+	resolved, err := r.request(req, true)
+	if err != nil {
+		return err
+	}
+	return r.h.FileCmd.Filecmd(resolved)
+}
+
+// PosixRename handles renames made with the posix-rename@openssh.com
+// extension, which replace the target if it exists. Like the sftp server, it
+// falls back to a plain rename if h doesn't support them.
+func (r *restricted) PosixRename(req *sftp.Request) error {
+	resolved, err := r.request(req, true)
+	if err != nil {
+		return err
+	}
+	if posixRenamer, ok := r.h.FileCmd.(sftp.PosixRenameFileCmder); ok {
+		return posixRenamer.PosixRename(resolved)
+	}
+	resolved.Method = "Rename"
+	return r.h.FileCmd.Filecmd(resolved)
+}
+
+func (r *restricted) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	resolved, err := r.request(req, false)
+	if err != nil {
+		return nil, err
+	}
+	return r.h.FileList.Filelist(resolved)
+}
+
+// permissionDenied returns the error for a request to p that isn't allowed.
+func permissionDenied(op string, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: syscall.EACCES}
+}
@@ -0,0 +1,108 @@
+package handlers_test
+
+import (
+	"errors"
+	"os"
+
+	"github.com/flawedmatrix/gocryptsftp/backend"
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+	"github.com/flawedmatrix/gocryptsftp/handlers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/sftp"
+)
+
+var _ = Describe("RestrictedHandler", func() {
+	var (
+		root       string
+		full       sftp.Handlers
+		access     handlers.Access
+		restricted sftp.Handlers
+	)
+
+	BeforeEach(func() {
+		root = newLocalRoot()
+		var err error
+		full, err = handlers.DecryptHandler(root, []byte(testPassword), 2, backend.NewLocalFS("/"), filetree.DefaultOptions())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(full.FileCmd.Filecmd(sftp.NewRequest("Mkdir", "/2020"))).To(Succeed())
+		Expect(writeFile(full, "/2020/a.txt", "a")).To(Succeed())
+		Expect(writeFile(full, "/secret.txt", "secret")).To(Succeed())
+
+		access = handlers.Access{Root: "/2020"}
+	})
+
+	JustBeforeEach(func() {
+		restricted = handlers.RestrictedHandler(full, access)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	It("serves the files under the root as the root", func() {
+		infos, err := list(restricted, "List", "/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(infos)).To(Equal([]string{"a.txt"}))
+		Expect(readFile(restricted, "/a.txt")).To(Equal("a"))
+
+		_, err = readFile(restricted, "/secret.txt")
+		Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+	})
+
+	It("makes changes under the root", func() {
+		Expect(writeFile(restricted, "/b.txt", "b")).To(Succeed())
+		Expect(restricted.FileCmd.Filecmd(sftp.NewRequest("Mkdir", "/dir"))).To(Succeed())
+		req := sftp.NewRequest("Rename", "/a.txt")
+		req.Target = "/dir/a.txt"
+		Expect(restricted.FileCmd.Filecmd(req)).To(Succeed())
+
+		Expect(readFile(full, "/2020/b.txt")).To(Equal("b"))
+		Expect(readFile(full, "/2020/dir/a.txt")).To(Equal("a"))
+	})
+
+	It("denies paths that lead outside of the root", func() {
+		req := sftp.NewRequest("Get", "/")
+		req.Filepath = "/../secret.txt"
+		_, err := restricted.FileGet.Fileread(req)
+		Expect(errors.Is(err, os.ErrPermission)).To(BeTrue())
+
+		req = sftp.NewRequest("Rename", "/a.txt")
+		req.Target = "../a.txt"
+		err = restricted.FileCmd.Filecmd(req)
+		Expect(errors.Is(err, os.ErrPermission)).To(BeTrue())
+		Expect(readFile(full, "/2020/a.txt")).To(Equal("a"))
+	})
+
+	Context("when the access is read-only", func() {
+		BeforeEach(func() {
+			access.ReadOnly = true
+		})
+
+		It("serves the files", func() {
+			Expect(readFile(restricted, "/a.txt")).To(Equal("a"))
+			infos, err := list(restricted, "Stat", "/a.txt")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names(infos)).To(Equal([]string{"a.txt"}))
+		})
+
+		It("denies every change", func() {
+			err := writeFile(restricted, "/b.txt", "b")
+			Expect(errors.Is(err, os.ErrPermission)).To(BeTrue())
+
+			for _, method := range []string{"Mkdir", "Remove", "Rmdir", "Setstat", "Rename", "Symlink"} {
+				req := sftp.NewRequest(method, "/a.txt")
+				req.Target = "/b.txt"
+				err := restricted.FileCmd.Filecmd(req)
+				Expect(errors.Is(err, os.ErrPermission)).To(BeTrue(), method)
+			}
+
+			req := sftp.NewRequest("PosixRename", "/a.txt")
+			req.Target = "/b.txt"
+			err = restricted.FileCmd.(sftp.PosixRenameFileCmder).PosixRename(req)
+			Expect(errors.Is(err, os.ErrPermission)).To(BeTrue())
+
+			Expect(readFile(full, "/2020/a.txt")).To(Equal("a"))
+		})
+	})
+})
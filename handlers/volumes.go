@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+	"github.com/pkg/sftp"
+)
+
+// Volume is a gocryptfs root served as a top-level directory by
+// VolumesHandler.
+type Volume struct {
+	Name string
+
+	d *decrypt
+}
+
+// NewVolume opens the gocryptfs root at encryptedRoot, to be served as the
+// directory /name.
+func NewVolume(name string, encryptedRoot string, password []byte, numWorkers int, fsAccessor filetree.FSAccessor, opts filetree.Options) (*Volume, error) {
+	ft, err := filetree.Init(encryptedRoot, password, numWorkers, fsAccessor, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Volume{Name: name, d: &decrypt{ft: ft}}, nil
+}
+
+// Handlers returns the handlers serving the volume at the root, on its own.
+func (v *Volume) Handlers() sftp.Handlers {
+	return sftp.Handlers{
+		FileGet:  v.d,
+		FilePut:  v.d,
+		FileCmd:  v.d,
+		FileList: v.d,
+	}
+}
+
+// Close stops the requests made to the remote of the volume, and wipes its
+// keys from memory. The volume must not be served afterwards.
+func (v *Volume) Close() {
+	v.d.ft.Close()
+}
+
+// VolumesHandler serves each volume as a top-level directory. The root only
+// lists the volumes, and is answered without touching any of them. Nothing
+// can be created, removed or renamed in the root.
+func VolumesHandler(volumes []*Volume) sftp.Handlers {
+	h := &volumeRouter{
+		volumes: map[string]*decrypt{},
+		root:    dirInfo{name: "/", modTime: time.Now()},
+	}
+	for _, v := range volumes {
+		h.volumes[v.Name] = v.d
+		h.listing = append(h.listing, dirInfo{name: v.Name, modTime: h.root.modTime})
+	}
+	sort.Slice(h.listing, func(i, j int) bool {
+		return h.listing[i].Name() < h.listing[j].Name()
+	})
+	return sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	}
+}
+
+type volumeRouter struct {
+	volumes map[string]*decrypt
+	root    dirInfo
+	listing []os.FileInfo
+}
+
+// route splits p into the name of its volume and the path within the
+// volume. The name is empty for the root. It fails if there's no such
+// volume.
+func (h *volumeRouter) route(op string, p string) (string, *decrypt, string, error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return "", nil, "/", nil
+	}
+	parts := strings.SplitN(p[1:], "/", 2)
+	d, found := h.volumes[parts[0]]
+	if !found {
+		return "", nil, "", &os.PathError{Op: op, Path: p, Err: syscall.ENOENT}
+	}
+	if len(parts) == 1 {
+		return parts[0], d, "/", nil
+	}
+	return parts[0], d, "/" + parts[1], nil
+}
+
+// routeInVolume is like route, but fails with a permission error if p is in
+// the root rather than in a volume, since nothing can be changed there.
+func (h *volumeRouter) routeInVolume(op string, p string) (string, *decrypt, string, error) {
+	if path.Dir(path.Clean("/"+p)) == "/" {
+		return "", nil, "", permissionDenied(op, p)
+	}
+	return h.route(op, p)
+}
+
+func (h *volumeRouter) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	v, err := h.fileread(req)
+	return v, clientError(req.Method, req.Filepath, err)
+}
+
+func (h *volumeRouter) fileread(req *sftp.Request) (io.ReaderAt, error) {
+	_, d, volPath, err := h.routeInVolume("open", req.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return d.fileread(volPath)
+}
+
+func (h *volumeRouter) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	v, err := h.filewrite(req)
+	return v, clientError(req.Method, req.Filepath, err)
+}
+
+func (h *volumeRouter) filewrite(req *sftp.Request) (io.WriterAt, error) {
+	_, d, volPath, err := h.routeInVolume("open", req.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return d.filewrite(volPath, req.Pflags())
+}
+
+func (h *volumeRouter) Filecmd(req *sftp.Request) error {
+	return clientError(req.Method, req.Filepath, h.filecmd(req))
+}
+
+func (h *volumeRouter) filecmd(req *sftp.Request) error {
+	name, d, volPath, err := h.routeInVolume(strings.ToLower(req.Method), req.Filepath)
+	if err != nil {
+		return err
+	}
+	var volTarget string
+	if req.Method == "Rename" {
+		if volTarget, err = h.renameTarget(name, req.Filepath, req.Target); err != nil {
+			return err
+		}
+	}
+	return d.filecmd(req.Method, volPath, volTarget)
+}
+
+// PosixRename handles renames made with the posix-rename@openssh.com
+// extension, which replace the target if it exists.
+func (h *volumeRouter) PosixRename(req *sftp.Request) error {
+	return clientError(req.Method, req.Filepath, h.posixRename(req))
+}
+
+func (h *volumeRouter) posixRename(req *sftp.Request) error {
+	name, d, volPath, err := h.routeInVolume("rename", req.Filepath)
+	if err != nil {
+		return err
+	}
+	volTarget, err := h.renameTarget(name, req.Filepath, req.Target)
+	if err != nil {
+		return err
+	}
+	return d.ft.PosixRename(volPath, volTarget)
+}
+
+// renameTarget returns the path of target within the volume name, which
+// renaming p to target must not leave.
+func (h *volumeRouter) renameTarget(name string, p string, target string) (string, error) {
+	targetName, _, volTarget, err := h.routeInVolume("rename", target)
+	if err != nil {
+		return "", err
+	}
+	if targetName != name {
+		return "", &os.LinkError{Op: "rename", Old: p, New: target, Err: syscall.EXDEV}
+	}
+	return volTarget, nil
+}
+
+func (h *volumeRouter) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	v, err := h.filelist(req)
+	return v, clientError(req.Method, req.Filepath, err)
+}
+
+func (h *volumeRouter) filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	name, d, volPath, err := h.route(strings.ToLower(req.Method), req.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case d == nil && req.Method == "List":
+		return listerat(h.listing), nil
+	case d == nil && req.Method == "Stat":
+		return listerat([]os.FileInfo{h.root}), nil
+	case d == nil:
+		return nil, fmt.Errorf("%s not supported. path: %s", req.Method, req.Filepath)
+	case volPath == "/" && req.Method == "Stat":
+		return listerat([]os.FileInfo{dirInfo{name: name, modTime: h.root.modTime}}), nil
+	}
+	return d.filelist(req.Method, volPath)
+}
+
+// dirInfo is the file info of the root and the top-level directories of the
+// volumes.
+type dirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (d dirInfo) Name() string       { return d.name }
+func (d dirInfo) Size() int64        { return 0 }
+func (d dirInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (d dirInfo) ModTime() time.Time { return d.modTime }
+func (d dirInfo) IsDir() bool        { return true }
+func (d dirInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,141 @@
+package handlers_test
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+	"github.com/flawedmatrix/gocryptsftp/filetree/filetreefakes"
+	"github.com/flawedmatrix/gocryptsftp/filetree/filetreetest"
+	"github.com/flawedmatrix/gocryptsftp/handlers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/sftp"
+)
+
+var _ = Describe("VolumesHandler", func() {
+	var (
+		fakes   []*filetreefakes.FakeFSAccessor
+		handler sftp.Handlers
+	)
+
+	BeforeEach(func() {
+		fakes = nil
+		var volumes []*handlers.Volume
+		for _, name := range []string{"photos", "docs"} {
+			mfs := filetreetest.NewMemFS()
+			err := mfs.AddVolume("/encrypted", []byte(testPassword), filetreetest.Tree{}, filetreetest.VolumeOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			fake := mfs.Fake()
+			volume, err := handlers.NewVolume(name, "/encrypted", []byte(testPassword), 2, fake, filetree.DefaultOptions())
+			Expect(err).NotTo(HaveOccurred())
+			fakes = append(fakes, fake)
+			volumes = append(volumes, volume)
+		}
+		handler = handlers.VolumesHandler(volumes)
+	})
+
+	It("lists the volumes at the root without touching them", func() {
+		statCalls := fakes[0].StatCallCount()
+		readDirCalls := fakes[0].ReadDirCallCount()
+
+		infos, err := list(handler, "List", "/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(infos)).To(Equal([]string{"docs", "photos"}))
+		Expect(infos[0].IsDir()).To(BeTrue())
+
+		infos, err = list(handler, "Stat", "/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infos[0].IsDir()).To(BeTrue())
+
+		infos, err = list(handler, "Stat", "/photos")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(infos)).To(Equal([]string{"photos"}))
+		Expect(infos[0].IsDir()).To(BeTrue())
+
+		Expect(fakes[0].StatCallCount()).To(Equal(statCalls))
+		Expect(fakes[0].ReadDirCallCount()).To(Equal(readDirCalls))
+	})
+
+	It("serves each volume under its name", func() {
+		Expect(writeFile(handler, "/photos/a.txt", "photo")).To(Succeed())
+		Expect(writeFile(handler, "/docs/a.txt", "doc")).To(Succeed())
+
+		Expect(readFile(handler, "/photos/a.txt")).To(Equal("photo"))
+		Expect(readFile(handler, "/docs/a.txt")).To(Equal("doc"))
+
+		infos, err := list(handler, "List", "/photos")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(infos)).To(Equal([]string{"a.txt"}))
+
+		Expect(handler.FileCmd.Filecmd(sftp.NewRequest("Mkdir", "/docs/dir"))).To(Succeed())
+		infos, err = list(handler, "Stat", "/docs/dir")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infos[0].IsDir()).To(BeTrue())
+		_, err = list(handler, "Stat", "/photos/dir")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("renames files within a volume", func() {
+		Expect(writeFile(handler, "/photos/a.txt", "photo")).To(Succeed())
+		req := sftp.NewRequest("Rename", "/photos/a.txt")
+		req.Target = "/photos/b.txt"
+		Expect(handler.FileCmd.Filecmd(req)).To(Succeed())
+		Expect(readFile(handler, "/photos/b.txt")).To(Equal("photo"))
+	})
+
+	It("rejects hard links", func() {
+		Expect(writeFile(handler, "/photos/a.txt", "photo")).To(Succeed())
+		req := sftp.NewRequest("Link", "/photos/b.txt")
+		req.Target = "/photos/a.txt"
+		Expect(handler.FileCmd.Filecmd(req)).To(Equal(sftp.ErrSSHFxOpUnsupported))
+	})
+
+	It("doesn't rename files to another volume", func() {
+		Expect(writeFile(handler, "/photos/a.txt", "photo")).To(Succeed())
+		req := sftp.NewRequest("Rename", "/photos/a.txt")
+		req.Target = "/docs/a.txt"
+		err := handler.FileCmd.Filecmd(req)
+		Expect(errors.Is(err, syscall.EXDEV)).To(BeTrue())
+		Expect(readFile(handler, "/photos/a.txt")).To(Equal("photo"))
+	})
+
+	// sftp only recognises these errors when they aren't wrapped, which is
+	// why the tests check them with os.IsNotExist rather than errors.Is.
+	It("returns errors about files in a volume that sftp understands", func() {
+		_, err := list(handler, "Stat", "/photos/missing")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		_, err = readFile(handler, "/photos/missing")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		err = handler.FileCmd.Filecmd(sftp.NewRequest("Remove", "/photos/missing"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		Expect(writeFile(handler, "/photos/a.txt", "photo")).To(Succeed())
+		req := sftp.NewRequest("Put", "/photos/a.txt")
+		req.Flags = 0x02 | 0x08 | 0x10 | 0x20 // WRITE|CREAT|TRUNC|EXCL
+		_, err = handler.FilePut.Filewrite(req)
+		Expect(os.IsExist(err)).To(BeTrue())
+	})
+
+	It("returns a not found error for unknown volumes", func() {
+		_, err := list(handler, "List", "/music")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		_, err = readFile(handler, "/music/a.txt")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("doesn't allow changing the root", func() {
+		err := writeFile(handler, "/a.txt", "root")
+		Expect(os.IsPermission(err)).To(BeTrue())
+		err = handler.FileCmd.Filecmd(sftp.NewRequest("Mkdir", "/music"))
+		Expect(os.IsPermission(err)).To(BeTrue())
+		err = handler.FileCmd.Filecmd(sftp.NewRequest("Rmdir", "/photos"))
+		Expect(os.IsPermission(err)).To(BeTrue())
+
+		req := sftp.NewRequest("Rename", "/photos")
+		req.Target = "/pictures"
+		err = handler.FileCmd.Filecmd(req)
+		Expect(os.IsPermission(err)).To(BeTrue())
+	})
+})
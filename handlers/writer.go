@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+)
+
+// writerat buffers everything written to a file by the client, and encrypts
+// and uploads the whole file when the client closes it. gocryptfs
+// authenticates each block together with the file ID, so it's far simpler to
+// encrypt the final plaintext once than to patch the ciphertext as writes
+// come in at arbitrary offsets.
+type writerat struct {
+	ft   *filetree.FileTree
+	path string
+	// maxSize is the largest file the client may write, since the whole file
+	// is held in memory.
+	maxSize int64
+
+	lock sync.Mutex
+	buf  []byte
+	// err records why the transfer failed, in which case nothing is
+	// uploaded when the file is closed.
+	err error
+}
+
+// Modeled after WriteAt() on a bytes.Buffer-like type. Gaps left by writing
+// past the end of the file are filled with zeros.
+func (w *writerat) WriteAt(p []byte, off int64) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+	if off < 0 {
+		w.err = fmt.Errorf("WriteAt: negative offset %d. path: %s", off, w.path)
+		return 0, w.err
+	}
+	limit := w.maxSize
+	if off > limit || int64(len(p)) > limit-off {
+		w.err = fmt.Errorf("WriteAt: file would be larger than the limit of %d bytes. path: %s", limit, w.path)
+		return 0, w.err
+	}
+	end := off + int64(len(p))
+	if end > int64(len(w.buf)) {
+		if end > int64(cap(w.buf)) {
+			newCap := limit
+			if end <= limit/2 {
+				newCap = 2 * end
+			}
+			newBuf := make([]byte, len(w.buf), newCap)
+			copy(newBuf, w.buf)
+			w.buf = newBuf
+		}
+		w.buf = w.buf[:end]
+	}
+	copy(w.buf[off:], p)
+	return len(p), nil
+}
+
+// TransferError is called by sftp when the transfer fails, such as when the
+// client disconnects in the middle of it.
+func (w *writerat) TransferError(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Close encrypts the buffered plaintext and writes it to the backend, unless
+// the transfer failed. The file on the backend is left as it was then, rather
+// than replaced with a partial upload.
+func (w *writerat) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err != nil {
+		return errors.New("file not written, the transfer failed: " + w.err.Error())
+	}
+	_, err := w.ft.WriteFile(w.path, w.buf)
+	return err
+}
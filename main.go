@@ -6,30 +6,58 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/flawedmatrix/gocryptsftp/backend"
 	"github.com/flawedmatrix/gocryptsftp/config"
-	"github.com/flawedmatrix/gocryptsftp/handlers"
-	"github.com/pkg/sftp"
-	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/knownhosts"
+	"github.com/flawedmatrix/gocryptsftp/gocrypt/exitcodes"
+	"github.com/flawedmatrix/gocryptsftp/server"
 )
 
 // Based on example server code from golang.org/x/crypto/ssh and server_standalone
 func main() {
 	var (
-		debugStderr bool
-		configPath  string
+		debugStderr  bool
+		configPath   string
+		hashPassword bool
+		serverFlags  config.ServerConfig
 	)
 
 	flag.BoolVar(&debugStderr, "e", false, "debug to stderr")
 	flag.StringVar(&configPath, "c", "", "path to program config")
-	flag.Parse()
+	flag.BoolVar(&hashPassword, "hash-password", false, "prompt for a proxy password and print its hash for ProxyPasswordHash")
+	flag.StringVar(&serverFlags.ListenAddr, "listen", "", "address to listen on, as host:port or unix:/path/to/socket (overrides Server.ListenAddr)")
+	flag.IntVar(&serverFlags.Workers, "workers", 0, "number of parallel requests to the remote (overrides Server.Workers)")
+	flag.IntVar(&serverFlags.PoolCapacity, "pool-capacity", 0, "number of idle connections kept to the remote (overrides Server.PoolCapacity)")
+	flag.IntVar(&serverFlags.MaxConnections, "max-connections", 0, "number of connections that can be open to the remote at once (overrides Server.MaxConnections)")
+	flag.IntVar(&serverFlags.WorkQueueSize, "work-queue-size", 0, "number of queued requests to the remote (overrides Server.WorkQueueSize)")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [check-config] [flags]\n\n", os.Args[0])
+		fmt.Fprintln(out, "check-config validates the config and checks the remote without starting the server.")
+		fmt.Fprintln(out)
+		flag.PrintDefaults()
+	}
+
+	args := os.Args[1:]
+	checkOnly := len(args) > 0 && args[0] == "check-config"
+	if checkOnly {
+		args = args[1:]
+	}
+	_ = flag.CommandLine.Parse(args)
+
+	if hashPassword {
+		hash, err := config.PromptPasswordHash()
+		if err != nil {
+			log.Fatalln("error hashing password:", err)
+		}
+		fmt.Println(hash)
+		return
+	}
 
 	debugStream := ioutil.Discard
 	if debugStderr {
@@ -42,131 +70,75 @@ func main() {
 	if err != nil {
 		log.Fatalln("error loading config file:", err)
 	}
-
-	// An SSH server is represented by a ServerConfig, which holds
-	// certificate details and handles authentication of ServerConns.
-	sshConfig := &ssh.ServerConfig{
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			// Should use constant-time compare (or better, salt+hash) in
-			// a production setting.
-			logger.Println("Login:", c.User())
-			if c.User() == cfg.ProxyUser && string(pass) == cfg.ProxyPassword {
-				return nil, nil
-			}
-			return nil, fmt.Errorf("password rejected for %q", c.User())
-		},
-	}
-
-	private, err := cfg.LoadSSHKey()
-	if err != nil {
-		log.Fatalln("error loading SSH key:", err)
-	}
-
-	sshConfig.AddHostKey(private)
-
-	hostKeyCallback, err := knownhosts.New(cfg.KnownHostsPath)
-	if err != nil {
-		log.Fatalln("error parsing known hosts file key:", err)
+	overrideServerConfig(&cfg.Server, serverFlags)
+	if checkOnly {
+		if !checkConfig(cfg, os.Stdout) {
+			os.Exit(1)
+		}
+		return
 	}
-
-	clientConfig := &ssh.ClientConfig{
-		User: cfg.Remote.User,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(private),
-		},
-		HostKeyCallback: hostKeyCallback,
+	if err := cfg.Validate(); err != nil {
+		log.Fatalln(err)
 	}
 
-	decryptPass, err := cfg.GetDecrpytionPassphrase()
+	srv, err := server.New(cfg, logger)
 	if err != nil {
-		log.Fatalln("error getting decryption passphrase", err)
+		log.Fatalln(err)
 	}
 
-	backendProvider := backend.NewProvider(cfg.Remote.Addr, clientConfig, logger)
-	reqHandlers, err := handlers.DecryptHandler(cfg.Remote.FileRoot, decryptPass, 32, backendProvider)
-	if err != nil {
-		log.Fatal("Failed to init handler", err)
+	// Once the server has been set up, connections can be accepted.
+	network, addr := cfg.Server.Listener()
+	if network == "unix" {
+		removeStaleSocket(addr)
 	}
-
-	// Once a ServerConfig has been configured, connections can be
-	// accepted.
-	listener, err := net.Listen("tcp", "0.0.0.0:9022")
+	listener, err := net.Listen(network, addr)
 	if err != nil {
 		log.Fatal("failed to listen for connection", err)
 	}
 	log.Printf("Listening on %v\n", listener.Addr())
 
-	for {
-		nConn, err := listener.Accept()
-		if err != nil {
-			logger.Println("failed to accept incoming connection", err)
-			continue
-		}
-		// Before use, a handshake must be performed on the incoming
-		// net.Conn.
-		_, chans, reqs, err := ssh.NewServerConn(nConn, sshConfig)
-		if err != nil {
-			logger.Println("failed to handshake", err)
-			continue
-		}
-		logger.Println("SSH server established")
-
-		// The incoming Request channel must be serviced.
-		go ssh.DiscardRequests(reqs)
-
-		go handleChannels(chans, reqHandlers, logger)
+	shutDown := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down\n", sig)
+		srv.Shutdown(cfg.Server.ShutdownTimeout.Duration)
+		close(shutDown)
+	}()
+
+	if err := srv.Serve(listener); err != server.ErrServerClosed {
+		log.Fatalln("error serving:", err)
 	}
+	<-shutDown
+	log.Println("Shut down")
+	os.Exit(exitcodes.SigInt)
 }
 
-func handleChannels(chans <-chan ssh.NewChannel, reqHandlers sftp.Handlers, logger *log.Logger) {
-	// Service the incoming Channel channel in go routine
-	for newChannel := range chans {
-		logger.Printf("Incoming channel: %s\n", newChannel.ChannelType())
-		go handleChannel(newChannel, reqHandlers, logger)
-	}
-}
-
-func handleChannel(newChannel ssh.NewChannel, reqHandlers sftp.Handlers, logger *log.Logger) {
-	// Channels have a type, depending on the application level
-	// protocol intended. In the case of an SFTP session, this is "subsystem"
-	// with a payload string of "<length=4>sftp"
-	if newChannel.ChannelType() != "session" {
-		_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-		logger.Printf("Unknown channel type: %s\n", newChannel.ChannelType())
-		return
-	}
-	channel, requests, err := newChannel.Accept()
-	if err != nil {
-		logger.Println("could not accept channel:", err)
-		return
-	}
-	logger.Println("Channel accepted")
-
-	// Sessions have out-of-band requests such as "shell",
-	// "pty-req" and "env".  Here we handle only the
-	// "subsystem" request.
-	go func(in <-chan *ssh.Request) {
-		for req := range in {
-			logger.Printf("Request: %v\n", req.Type)
-			ok := false
-			switch req.Type {
-			case "subsystem":
-				logger.Printf("Subsystem: %s\n", req.Payload[4:])
-				if string(req.Payload[4:]) == "sftp" {
-					ok = true
-				}
-			}
-			logger.Printf(" - accepted: %v\n", ok)
-			_ = req.Reply(ok, nil)
+// overrideServerConfig replaces the settings in s with the ones that were
+// given on the command line.
+func overrideServerConfig(s *config.ServerConfig, flags config.ServerConfig) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			s.ListenAddr = flags.ListenAddr
+		case "workers":
+			s.Workers = flags.Workers
+		case "pool-capacity":
+			s.PoolCapacity = flags.PoolCapacity
+		case "max-connections":
+			s.MaxConnections = flags.MaxConnections
+		case "work-queue-size":
+			s.WorkQueueSize = flags.WorkQueueSize
 		}
-	}(requests)
-
-	server := sftp.NewRequestServer(channel, reqHandlers)
+	})
+}
 
-	if err := server.Serve(); err == io.EOF {
-		server.Close()
-		logger.Println("sftp client exited session.")
-	} else if err != nil {
-		logger.Println("sftp server completed with error:", err)
+// removeStaleSocket removes the unix socket left behind at path by a previous
+// run, so that it can be listened on again. Anything else at path is left
+// alone, and makes listening fail instead.
+func removeStaleSocket(path string) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
 	}
 }
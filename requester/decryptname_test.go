@@ -45,6 +45,36 @@ var _ = Describe("DecryptName", func() {
 		Expect(decryptedName).To(Equal(expectedName))
 	})
 
+	Context("when the name is cleared from the cache", func() {
+		It("decrypts the name again on the next request", func() {
+			_, err := rqtr.DecryptName("encrypted12345", []byte("IV"))
+			Expect(err).NotTo(HaveOccurred())
+
+			rqtr.ClearName("encrypted12345", []byte("IV"))
+
+			_, err = rqtr.DecryptName("encrypted12345", []byte("IV"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decrypter.DecryptNameCallCount()).To(Equal(2))
+		})
+	})
+
+	Context("when the names for the IV are cleared from the cache", func() {
+		It("decrypts the name again on the next request", func() {
+			_, err := rqtr.DecryptName("encrypted12345", []byte("IV"))
+			Expect(err).NotTo(HaveOccurred())
+
+			rqtr.ClearNames([]byte("Other IV"))
+			_, err = rqtr.DecryptName("encrypted12345", []byte("IV"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decrypter.DecryptNameCallCount()).To(Equal(1))
+
+			rqtr.ClearNames([]byte("IV"))
+			_, err = rqtr.DecryptName("encrypted12345", []byte("IV"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decrypter.DecryptNameCallCount()).To(Equal(2))
+		})
+	})
+
 	Context("when an error occurs while decrypting", func() {
 		It("returns the error", func() {
 			decryptedName, err := rqtr.DecryptName("encrypted12345", []byte("Bad IV"))
@@ -0,0 +1,167 @@
+package requester_test
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/flawedmatrix/gocryptsftp/requester"
+	"github.com/flawedmatrix/gocryptsftp/requester/requesterfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limits", func() {
+	var (
+		backend *requesterfakes.FakeBackend
+		limits  requester.Limits
+		rqtr    *requester.Requester
+	)
+
+	BeforeEach(func() {
+		backend = new(requesterfakes.FakeBackend)
+		backend.ReadFileStub = func(path string) ([]byte, error) {
+			if strings.HasPrefix(path, "/big") {
+				return make([]byte, 1000), nil
+			}
+			return []byte(path), nil
+		}
+		limits = requester.Limits{}
+	})
+
+	JustBeforeEach(func() {
+		rqtr = requester.NewWithLimits(10, backend, nil, limits)
+		rqtr.Start()
+	})
+
+	AfterEach(func() {
+		rqtr.Stop()
+	})
+
+	readFile := func(path string) {
+		b, err := rqtr.ReadFile(path)
+		ExpectWithOffset(1, err).NotTo(HaveOccurred())
+		ExpectWithOffset(1, b).NotTo(BeEmpty())
+	}
+
+	Context("when the work queue is small", func() {
+		BeforeEach(func() {
+			limits.WorkQueueSize = 1
+		})
+
+		It("still serves many concurrent requests", func() {
+			done := make(chan struct{})
+			for i := 0; i < 50; i++ {
+				go func(i int) {
+					defer GinkgoRecover()
+					readFile(fmt.Sprintf("/concurrent/%d", i))
+					done <- struct{}{}
+				}(i)
+			}
+			for i := 0; i < 50; i++ {
+				Eventually(done).Should(Receive())
+			}
+			Expect(backend.ReadFileCallCount()).To(Equal(50))
+		})
+	})
+
+	Context("when the number of entries is limited", func() {
+		BeforeEach(func() {
+			limits.File.MaxEntries = 2
+		})
+
+		It("evicts the least recently used entries", func() {
+			readFile("/a")
+			readFile("/b")
+			readFile("/a")
+			readFile("/c")
+			Expect(backend.ReadFileCallCount()).To(Equal(3))
+
+			// /b was the least recently used when /c was added
+			readFile("/a")
+			readFile("/c")
+			Expect(backend.ReadFileCallCount()).To(Equal(3))
+			readFile("/b")
+			Expect(backend.ReadFileCallCount()).To(Equal(4))
+		})
+	})
+
+	Context("when the size of the cache is limited", func() {
+		BeforeEach(func() {
+			limits.File.MaxBytes = 2500
+		})
+
+		It("evicts entries until the cache fits", func() {
+			readFile("/big1")
+			readFile("/big2")
+			readFile("/big3")
+			Expect(backend.ReadFileCallCount()).To(Equal(3))
+
+			readFile("/big2")
+			readFile("/big3")
+			Expect(backend.ReadFileCallCount()).To(Equal(3))
+			readFile("/big1")
+			Expect(backend.ReadFileCallCount()).To(Equal(4))
+		})
+	})
+
+	Context("when a single entry is bigger than the cache", func() {
+		BeforeEach(func() {
+			limits.File.MaxBytes = 10
+		})
+
+		It("still returns it", func() {
+			b, err := rqtr.ReadFile("/big")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(HaveLen(1000))
+		})
+	})
+
+	Context("when entries have a TTL", func() {
+		BeforeEach(func() {
+			limits.File.TTL = 50 * time.Millisecond
+		})
+
+		It("requests them again once they expire", func() {
+			readFile("/a")
+			readFile("/a")
+			Expect(backend.ReadFileCallCount()).To(Equal(1))
+
+			time.Sleep(100 * time.Millisecond)
+			readFile("/a")
+			Expect(backend.ReadFileCallCount()).To(Equal(2))
+		})
+	})
+
+	Context("when there are no limits", func() {
+		It("keeps everything", func() {
+			for i := 0; i < 100; i++ {
+				readFile(fmt.Sprintf("/big%d", i))
+			}
+			for i := 0; i < 100; i++ {
+				readFile(fmt.Sprintf("/big%d", i))
+			}
+			Expect(backend.ReadFileCallCount()).To(Equal(100))
+		})
+	})
+
+	Context("when many concurrent requests exceed the limits", func() {
+		BeforeEach(func() {
+			limits.File.MaxEntries = 1
+		})
+
+		It("still completes every request", func() {
+			done := make(chan struct{})
+			for i := 0; i < 20; i++ {
+				go func(i int) {
+					defer GinkgoRecover()
+					readFile(fmt.Sprintf("/%d", i))
+					done <- struct{}{}
+				}(i)
+			}
+			for i := 0; i < 20; i++ {
+				Eventually(done).Should(Receive())
+			}
+		})
+	})
+})
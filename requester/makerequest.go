@@ -26,6 +26,9 @@ func (r *Requester) makeRequest(requestType workType, arg1 string, arg2 []byte)
 	}
 
 	for i := 0; i < cacheErrRetryAttempts; i++ {
+		if r.stopped() {
+			return nil, ErrStopped
+		}
 		// Return immediately if there is valid data in the cache, otherwise
 		// make a new request.
 		if cached, found := cache.Get(key); found {
@@ -34,11 +37,15 @@ func (r *Requester) makeRequest(requestType workType, arg1 string, arg2 []byte)
 			}
 		}
 		respChan := make(chan *workTicket)
-		r.workQueue <- work{
+		select {
+		case r.workQueue <- work{
 			requestType: requestType,
 			arg1:        arg1,
 			arg2:        arg2,
 			respChan:    respChan,
+		}:
+		case <-r.done:
+			return nil, ErrStopped
 		}
 		select {
 		case ticket, ok := <-respChan:
@@ -127,6 +134,8 @@ func (r *Requester) makeRequest(requestType workType, arg1 string, arg2 []byte)
 				return nil, err
 			}
 			return d, nil
+		case <-r.done:
+			return nil, ErrStopped
 		case <-time.After(20 * time.Second):
 			return nil, errors.New("nonresponsive work queue")
 		}
@@ -61,6 +61,30 @@ var _ = Describe("ReadDir", func() {
 		Expect(directory).To(Equal(expectedDirectory))
 	})
 
+	Context("when the directory is empty", func() {
+		It("returns an empty listing", func() {
+			expectedDirectory = nil
+			directory, err := rqtr.ReadDir("/expected/dir/path")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(directory).To(BeEmpty())
+		})
+	})
+
+	Context("when the directory is cleared from the cache", func() {
+		It("queries the backend again on the next read", func() {
+			_, err := rqtr.ReadDir("/expected/dir/path")
+			Expect(err).NotTo(HaveOccurred())
+
+			expectedDirectory = expectedDirectory[1:]
+			rqtr.ClearDir("/expected/dir/path")
+
+			directory, err := rqtr.ReadDir("/expected/dir/path")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(directory).To(Equal(expectedDirectory))
+			Expect(backend.ReadDirCallCount()).To(Equal(2))
+		})
+	})
+
 	Context("when an error occurs while reading", func() {
 		It("returns the error", func() {
 			directory, err := rqtr.ReadDir("/nonexistent/dir/path")
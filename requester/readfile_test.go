@@ -44,6 +44,84 @@ var _ = Describe("ReadFile", func() {
 		Expect(fileBytes).To(Equal(expectedFileBytes))
 	})
 
+	Context("when the file is empty", func() {
+		It("returns no bytes", func() {
+			expectedFileBytes = nil
+			fileBytes, err := rqtr.ReadFile("/expected/file/path")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fileBytes).To(BeEmpty())
+		})
+	})
+
+	It("only queries the backend once for repeated reads", func() {
+		for i := 0; i < 5; i++ {
+			_, err := rqtr.ReadFile("/expected/file/path")
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(backend.ReadFileCallCount()).To(Equal(1))
+	})
+
+	Context("when the file is cleared from the cache", func() {
+		It("queries the backend again on the next read", func() {
+			_, err := rqtr.ReadFile("/expected/file/path")
+			Expect(err).NotTo(HaveOccurred())
+
+			expectedFileBytes = []byte("New File Bytes")
+			rqtr.ClearFile("/expected/file/path")
+
+			fileBytes, err := rqtr.ReadFile("/expected/file/path")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fileBytes).To(Equal(expectedFileBytes))
+			Expect(backend.ReadFileCallCount()).To(Equal(2))
+		})
+	})
+
+	Context("when the files in its directory are cleared from the cache", func() {
+		It("queries the backend again on the next read", func() {
+			_, err := rqtr.ReadFile("/expected/file/path")
+			Expect(err).NotTo(HaveOccurred())
+
+			rqtr.ClearFilesIn("/expected")
+			_, err = rqtr.ReadFile("/expected/file/path")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backend.ReadFileCallCount()).To(Equal(1))
+
+			rqtr.ClearFilesIn("/expected/file")
+			_, err = rqtr.ReadFile("/expected/file/path")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backend.ReadFileCallCount()).To(Equal(2))
+		})
+	})
+
+	It("returns cached files without querying the backend", func() {
+		_, found := rqtr.CachedFile("/expected/file/path")
+		Expect(found).To(BeFalse())
+
+		_, err := rqtr.ReadFile("/expected/file/path")
+		Expect(err).NotTo(HaveOccurred())
+		fileBytes, found := rqtr.CachedFile("/expected/file/path")
+		Expect(found).To(BeTrue())
+		Expect(fileBytes).To(Equal(expectedFileBytes))
+		Expect(backend.ReadFileCallCount()).To(Equal(1))
+	})
+
+	Context("when a parent directory is cleared from the cache", func() {
+		It("queries the backend again on the next read", func() {
+			_, err := rqtr.ReadFile("/expected/file/path")
+			Expect(err).NotTo(HaveOccurred())
+
+			rqtr.ClearTree("/expected/file/pat")
+			_, err = rqtr.ReadFile("/expected/file/path")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backend.ReadFileCallCount()).To(Equal(1))
+
+			rqtr.ClearTree("/expected")
+			_, err = rqtr.ReadFile("/expected/file/path")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backend.ReadFileCallCount()).To(Equal(2))
+		})
+	})
+
 	Context("when an error occurs while reading", func() {
 		It("returns the error", func() {
 			fileBytes, err := rqtr.ReadFile("/nonexistent/file/path")
@@ -1,7 +1,10 @@
 package requester
 
 import (
+	"errors"
 	"os"
+	"path"
+	"strings"
 	"sync"
 )
 
@@ -41,6 +44,9 @@ type Requester struct {
 
 	workQueue chan work
 	lockers   []workTicket
+
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 type workType byte
@@ -79,22 +85,66 @@ func (wt *workTicket) Wait() {
 }
 
 const cacheErrRetryAttempts = 3
+
+// ErrStopped is returned for requests that can't be made because the
+// Requester was stopped.
+var ErrStopped = errors.New("requester is stopped")
+
 const initialCacheSize = 1000
-const workQueueSize = 1000
 
+// DefaultWorkQueueSize is the number of requests that can be queued up for
+// the workers before making new requests blocks.
+const DefaultWorkQueueSize = 1000
+
+// Limits holds the limits for each of the caches of a Requester, and for its
+// queue of requests.
+type Limits struct {
+	File    CacheLimits
+	Dir     CacheLimits
+	Decrypt CacheLimits
+
+	// WorkQueueSize is the number of requests that can be queued up for the
+	// workers. Zero means DefaultWorkQueueSize.
+	WorkQueueSize int
+}
+
+// DefaultLimits returns the limits used by New.
+func DefaultLimits() Limits {
+	return Limits{
+		File:    CacheLimits{MaxEntries: 10000, MaxBytes: 16 << 20},
+		Dir:     CacheLimits{MaxEntries: 10000, MaxBytes: 64 << 20},
+		Decrypt: CacheLimits{MaxEntries: 100000, MaxBytes: 32 << 20},
+
+		WorkQueueSize: DefaultWorkQueueSize,
+	}
+}
+
+// New creates a Requester whose caches are bounded by DefaultLimits.
 func New(numWorkers int, backend Backend, decrypter Decrypter) *Requester {
+	return NewWithLimits(numWorkers, backend, decrypter, DefaultLimits())
+}
+
+// NewWithLimits creates a Requester whose caches are bounded by the given
+// limits.
+func NewWithLimits(numWorkers int, backend Backend, decrypter Decrypter, limits Limits) *Requester {
+	workQueueSize := limits.WorkQueueSize
+	if workQueueSize <= 0 {
+		workQueueSize = DefaultWorkQueueSize
+	}
 	r := &Requester{
 		numWorkers: numWorkers,
 
 		backend:   backend,
 		decrypter: decrypter,
 
-		fileCache:    newSyncCache(initialCacheSize),
-		dirCache:     newSyncCache(initialCacheSize),
-		decryptCache: newSyncCache(initialCacheSize),
+		fileCache:    newSyncCache(initialCacheSize, limits.File),
+		dirCache:     newSyncCache(initialCacheSize, limits.Dir),
+		decryptCache: newSyncCache(initialCacheSize, limits.Decrypt),
 
 		workQueue: make(chan work, workQueueSize),
 		lockers:   make([]workTicket, numWorkers+1),
+
+		done: make(chan struct{}),
 	}
 	for i := 0; i < numWorkers+1; i++ {
 		l := &r.lockers[i]
@@ -110,8 +160,13 @@ func (r *Requester) Start() {
 	}
 }
 
+// Stop stops the workers once they finish their current requests. Requests
+// that are waiting for a worker, or made after Stop, fail with ErrStopped.
+// It's safe to call Stop more than once.
 func (r *Requester) Stop() {
-	close(r.workQueue)
+	r.stopOnce.Do(func() {
+		close(r.done)
+	})
 }
 
 func (r *Requester) ClearCache() {
@@ -120,6 +175,61 @@ func (r *Requester) ClearCache() {
 	r.decryptCache.ClearCache()
 }
 
+// ClearFile removes the cached contents of the file at the given path, so
+// that the next ReadFile on it queries the backend again.
+func (r *Requester) ClearFile(path string) {
+	r.fileCache.Delete(path)
+}
+
+// ClearDir removes the cached listing of the directory at the given path, so
+// that the next ReadDir on it queries the backend again.
+func (r *Requester) ClearDir(path string) {
+	r.dirCache.Delete(path)
+}
+
+// ClearName removes the cached decryption of the given ciphertext name with
+// the given initialization vector.
+func (r *Requester) ClearName(cName string, iv []byte) {
+	r.decryptCache.Delete(complexKey(cName, iv))
+}
+
+// ClearFilesIn removes the cached contents of the files directly inside the
+// directory at the given path.
+func (r *Requester) ClearFilesIn(dir string) {
+	r.fileCache.DeleteIf(func(key string) bool {
+		return path.Dir(key) == dir
+	})
+}
+
+// ClearNames removes the cached decryptions of all names decrypted with the
+// given initialization vector.
+func (r *Requester) ClearNames(iv []byte) {
+	suffix := complexKey("", iv)
+	r.decryptCache.DeleteIf(func(key string) bool {
+		return strings.HasSuffix(key, suffix)
+	})
+}
+
+// CachedFile returns the cached contents of the file at the given path
+// without querying the backend. It returns false if the file isn't cached.
+func (r *Requester) CachedFile(path string) ([]byte, bool) {
+	cached, found := r.fileCache.Get(path)
+	if !found || cached.data == nil {
+		return nil, false
+	}
+	return cached.data.([]byte), true
+}
+
+// ClearTree removes the cached contents and listings of the given path and of
+// every path under it.
+func (r *Requester) ClearTree(path string) {
+	under := func(key string) bool {
+		return key == path || strings.HasPrefix(key, path+"/")
+	}
+	r.fileCache.DeleteIf(under)
+	r.dirCache.DeleteIf(under)
+}
+
 func (r *Requester) performRequestAndCache(
 	key string, num int, cache *syncCache, responseCh chan *workTicket,
 	request func() (interface{}, error),
@@ -127,7 +237,9 @@ func (r *Requester) performRequestAndCache(
 	cacheEntry, loaded := cache.GetOrInsert(key, genCacheEntry{lockerNum: num})
 	if !loaded {
 		wt := &r.lockers[num]
-		responseCh <- wt
+		if !r.respond(responseCh, wt) {
+			return
+		}
 		wt.Lock()
 
 		data, err := request()
@@ -141,34 +253,67 @@ func (r *Requester) performRequestAndCache(
 			close(responseCh)
 		} else {
 			// Otherwise, send the current work ticket for the work.
-			wt := &r.lockers[cacheEntry.lockerNum]
-			responseCh <- wt
+			r.respond(responseCh, &r.lockers[cacheEntry.lockerNum])
 		}
 	}
 }
 
+// stopped returns true once Stop is called.
+func (r *Requester) stopped() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// respond sends wt to the requester waiting on responseCh. It returns false
+// if the Requester was stopped before the requester received it.
+func (r *Requester) respond(responseCh chan *workTicket, wt *workTicket) bool {
+	select {
+	case responseCh <- wt:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
 func (r *Requester) worker(num int) {
-	for {
-		w, ok := <-r.workQueue
+	for !r.stopped() {
+		var w work
+		select {
+		case w = <-r.workQueue:
+		case <-r.done:
+			return
+		}
 		switch w.requestType {
 		case workReadFile:
 			r.performRequestAndCache(w.arg1, num, r.fileCache, w.respChan,
 				func() (interface{}, error) {
 					fileData, err := r.backend.ReadFile(w.arg1)
-					if len(fileData) > 0 {
-						return fileData, err
+					if err != nil {
+						return nil, err
 					}
-					return nil, err
+					// Empty files are valid data, so they must not be
+					// mistaken for missing data.
+					if fileData == nil {
+						fileData = []byte{}
+					}
+					return fileData, nil
 				},
 			)
 		case workReadDir:
 			r.performRequestAndCache(w.arg1, num, r.dirCache, w.respChan,
 				func() (interface{}, error) {
 					dirData, err := r.backend.ReadDir(w.arg1)
-					if len(dirData) > 0 {
-						return dirData, err
+					if err != nil {
+						return nil, err
 					}
-					return nil, err
+					if dirData == nil {
+						dirData = []os.FileInfo{}
+					}
+					return dirData, nil
 				},
 			)
 		case workDecryptName:
@@ -184,8 +329,5 @@ func (r *Requester) worker(num int) {
 			)
 		case workNone:
 		}
-		if !ok {
-			return
-		}
 	}
 }
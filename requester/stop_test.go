@@ -0,0 +1,69 @@
+package requester_test
+
+import (
+	"errors"
+
+	"github.com/flawedmatrix/gocryptsftp/requester"
+	"github.com/flawedmatrix/gocryptsftp/requester/requesterfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stop", func() {
+	var (
+		backend *requesterfakes.FakeBackend
+		release chan struct{}
+		rqtr    *requester.Requester
+	)
+
+	BeforeEach(func() {
+		release = make(chan struct{})
+		backend = new(requesterfakes.FakeBackend)
+		backend.ReadFileStub = func(path string) ([]byte, error) {
+			<-release
+			return []byte(path), nil
+		}
+
+		rqtr = requester.NewWithLimits(1, backend, nil, requester.Limits{WorkQueueSize: 1})
+		rqtr.Start()
+	})
+
+	It("finishes the request in progress and fails the waiting ones", func() {
+		slowResult := make(chan error)
+		go func() {
+			defer GinkgoRecover()
+			_, err := rqtr.ReadFile("/slow")
+			slowResult <- err
+		}()
+		Eventually(backend.ReadFileCallCount).Should(Equal(1))
+
+		waitingResult := make(chan error)
+		go func() {
+			defer GinkgoRecover()
+			_, err := rqtr.ReadFile("/waiting")
+			waitingResult <- err
+		}()
+		Consistently(waitingResult).ShouldNot(Receive())
+
+		rqtr.Stop()
+		var err error
+		Eventually(waitingResult).Should(Receive(&err))
+		Expect(errors.Is(err, requester.ErrStopped)).To(BeTrue())
+
+		close(release)
+		Eventually(slowResult).Should(Receive(BeNil()))
+		Expect(backend.ReadFileCallCount()).To(Equal(1))
+	})
+
+	It("fails requests made after it", func() {
+		rqtr.Stop()
+		_, err := rqtr.ReadFile("/file")
+		Expect(errors.Is(err, requester.ErrStopped)).To(BeTrue())
+		Expect(backend.ReadFileCallCount()).To(Equal(0))
+	})
+
+	It("can be called more than once", func() {
+		rqtr.Stop()
+		rqtr.Stop()
+	})
+})
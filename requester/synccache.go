@@ -1,40 +1,75 @@
 package requester
 
-import "sync"
+import (
+	"container/list"
+	"os"
+	"sync"
+	"time"
+)
 
+// CacheLimits bounds the size of a single cache. A zero value for any of the
+// fields means that dimension is unbounded.
+type CacheLimits struct {
+	// MaxEntries is the maximum number of entries kept in the cache.
+	MaxEntries int
+	// MaxBytes is the approximate maximum amount of memory taken up by the
+	// entries in the cache.
+	MaxBytes int64
+	// TTL is how long an entry is served from the cache before it's
+	// requested again.
+	TTL time.Duration
+}
+
+// fileInfoOverhead is a rough estimate of the memory taken up by a single
+// os.FileInfo in a directory listing, not counting its name.
+const fileInfoOverhead = 128
+
+type cacheItem struct {
+	key     string
+	entry   genCacheEntry
+	size    int64
+	expires time.Time
+}
+
+// syncCache is a thread-safe cache with LRU eviction. Entries that are still
+// waiting on a request to complete are never evicted, since other requests
+// may be waiting on them through a work ticket.
 type syncCache struct {
-	m    map[string]genCacheEntry
-	lock sync.RWMutex
+	limits CacheLimits
+
+	m     map[string]*list.Element
+	order *list.List
+	size  int64
+	lock  sync.Mutex
 }
 
-func newSyncCache(startingSize int) *syncCache {
+func newSyncCache(startingSize int, limits CacheLimits) *syncCache {
 	return &syncCache{
-		m: make(map[string]genCacheEntry, startingSize),
+		limits: limits,
+		m:      make(map[string]*list.Element, startingSize),
+		order:  list.New(),
 	}
 }
 
 // ClearCache empties the cache in a thread-safe way
 func (s *syncCache) ClearCache() {
-	keysToDelete := []string{}
-	s.lock.RLock()
-	for k := range s.m {
-		keysToDelete = append(keysToDelete, k)
-	}
-	s.lock.RUnlock()
 	s.lock.Lock()
-	for _, k := range keysToDelete {
-		delete(s.m, k)
-	}
+	s.m = make(map[string]*list.Element, len(s.m))
+	s.order.Init()
+	s.size = 0
 	s.lock.Unlock()
 }
 
 // Get retrieves the value associated with the key from the cache in a
 // thread-safe way
 func (s *syncCache) Get(key string) (genCacheEntry, bool) {
-	s.lock.RLock()
-	cacheEntry, found := s.m[key]
-	s.lock.RUnlock()
-	return cacheEntry, found
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, found := s.lookup(key)
+	if !found {
+		return genCacheEntry{}, false
+	}
+	return e.Value.(*cacheItem).entry, true
 }
 
 // GetOrInsert tries to retrieve the value associated with the key from the
@@ -43,19 +78,19 @@ func (s *syncCache) Get(key string) (genCacheEntry, bool) {
 // into the cache and returns false.
 func (s *syncCache) GetOrInsert(key string, value genCacheEntry) (genCacheEntry, bool) {
 	s.lock.Lock()
-	cacheEntry, loaded := s.m[key]
-	if !loaded {
-		s.m[key] = value
+	defer s.lock.Unlock()
+	if e, loaded := s.lookup(key); loaded {
+		return e.Value.(*cacheItem).entry, true
 	}
-	s.lock.Unlock()
-	return cacheEntry, loaded
+	s.set(key, value)
+	return genCacheEntry{}, false
 }
 
 // Set sets the the value associated with the key in the cache in a thread-safe
 // way
 func (s *syncCache) Set(key string, value genCacheEntry) {
 	s.lock.Lock()
-	s.m[key] = value
+	s.set(key, value)
 	s.lock.Unlock()
 }
 
@@ -63,6 +98,108 @@ func (s *syncCache) Set(key string, value genCacheEntry) {
 // thread-safe way
 func (s *syncCache) Delete(key string) {
 	s.lock.Lock()
-	delete(s.m, key)
+	if e, found := s.m[key]; found {
+		s.remove(e)
+	}
 	s.lock.Unlock()
 }
+
+// DeleteIf deletes every value whose key satisfies the predicate from the
+// cache in a thread-safe way
+func (s *syncCache) DeleteIf(pred func(key string) bool) {
+	s.lock.Lock()
+	for k, e := range s.m {
+		if pred(k) {
+			s.remove(e)
+		}
+	}
+	s.lock.Unlock()
+}
+
+// lookup finds the element for key and marks it as recently used. Expired
+// entries are removed and reported as not found. The lock must be held.
+func (s *syncCache) lookup(key string) (*list.Element, bool) {
+	e, found := s.m[key]
+	if !found {
+		return nil, false
+	}
+	item := e.Value.(*cacheItem)
+	if !item.expires.IsZero() && time.Now().After(item.expires) {
+		s.remove(e)
+		return nil, false
+	}
+	s.order.MoveToFront(e)
+	return e, true
+}
+
+// set stores value under key and evicts entries until the cache is within its
+// limits again. The lock must be held.
+func (s *syncCache) set(key string, value genCacheEntry) {
+	item := &cacheItem{
+		key:   key,
+		entry: value,
+		size:  entrySize(key, value),
+	}
+	if s.limits.TTL > 0 && !pending(value) {
+		item.expires = time.Now().Add(s.limits.TTL)
+	}
+	if e, found := s.m[key]; found {
+		s.size -= e.Value.(*cacheItem).size
+		e.Value = item
+		s.order.MoveToFront(e)
+	} else {
+		s.m[key] = s.order.PushFront(item)
+	}
+	s.size += item.size
+	s.evict(key)
+}
+
+// evict removes the least recently used entries until the cache is within its
+// limits, skipping pending entries and the entry for keep. The lock must be
+// held.
+func (s *syncCache) evict(keep string) {
+	e := s.order.Back()
+	for e != nil && s.overLimits() {
+		prev := e.Prev()
+		item := e.Value.(*cacheItem)
+		if item.key != keep && !pending(item.entry) {
+			s.remove(e)
+		}
+		e = prev
+	}
+}
+
+func (s *syncCache) overLimits() bool {
+	return (s.limits.MaxEntries > 0 && len(s.m) > s.limits.MaxEntries) ||
+		(s.limits.MaxBytes > 0 && s.size > s.limits.MaxBytes)
+}
+
+// remove removes the element from the cache. The lock must be held.
+func (s *syncCache) remove(e *list.Element) {
+	item := e.Value.(*cacheItem)
+	s.order.Remove(e)
+	delete(s.m, item.key)
+	s.size -= item.size
+}
+
+// pending returns true if the entry is a placeholder for a request that
+// hasn't completed yet.
+func pending(entry genCacheEntry) bool {
+	return entry.data == nil && entry.err == nil
+}
+
+// entrySize estimates the memory taken up by an entry in the cache.
+func entrySize(key string, entry genCacheEntry) int64 {
+	size := int64(len(key))
+	switch d := entry.data.(type) {
+	case []byte:
+		size += int64(len(d))
+	case string:
+		size += int64(len(d))
+	case []os.FileInfo:
+		for _, info := range d {
+			size += fileInfoOverhead + int64(len(info.Name()))
+		}
+	}
+	return size
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/flawedmatrix/gocryptsftp/backend"
+	"github.com/flawedmatrix/gocryptsftp/config"
+	"github.com/flawedmatrix/gocryptsftp/filetree"
+	"github.com/flawedmatrix/gocryptsftp/handlers"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// backends are the volumes being served, and the connections to their
+// remotes.
+type backends struct {
+	logger *log.Logger
+
+	volumes []*handlers.Volume
+	// providers are keyed by the remote they connect to, without its
+	// FileRoot.
+	providers map[config.RemoteConfig]*backend.Provider
+}
+
+// closeRemotes closes the connections to the remotes, which fails any
+// requests still waiting on them.
+func (b *backends) closeRemotes() {
+	for _, provider := range b.providers {
+		provider.Close()
+	}
+}
+
+// logStats logs the statistics of the pool of connections to each remote.
+func (b *backends) logStats() {
+	for remote, provider := range b.providers {
+		b.logger.Printf("Connections to %s@%s: %+v\n", remote.User, remote.Addr, provider.Stats())
+	}
+}
+
+// closeVolumes stops the volumes and wipes their keys from memory.
+func (b *backends) closeVolumes() {
+	for _, volume := range b.volumes {
+		volume.Close()
+	}
+}
+
+// volumeHandlers opens every configured volume, and returns the handlers
+// serving them. Volumes on the same remote, reached as the same user with the
+// same keys, share a pool of connections. Local volumes are read from the
+// local filesystem.
+func volumeHandlers(cfg *config.Config, hostKeyCallback ssh.HostKeyCallback, logger *log.Logger) (sftp.Handlers, *backends, error) {
+	ftOpts := filetree.DefaultOptions()
+	ftOpts.Cache = cfg.Cache.RequesterLimits()
+	ftOpts.Cache.WorkQueueSize = cfg.Server.WorkQueueSize
+	ftOpts.RevalidateInterval = cfg.Cache.RevalidateInterval.Duration
+	ftOpts.MaxFileSize = cfg.Server.MaxUploadSize
+
+	b := &backends{
+		logger:    logger,
+		providers: map[config.RemoteConfig]*backend.Provider{},
+	}
+	fail := func(err error) (sftp.Handlers, *backends, error) {
+		b.closeRemotes()
+		b.closeVolumes()
+		return sftp.Handlers{}, nil, err
+	}
+	for _, v := range cfg.AllVolumes() {
+		var fsAccessor filetree.FSAccessor
+		if v.Remote.Local {
+			fsAccessor = backend.NewLocalFS("/")
+		} else {
+			provider, err := b.remoteProvider(v, cfg.Server, hostKeyCallback, logger)
+			if err != nil {
+				return fail(err)
+			}
+			fsAccessor = provider
+		}
+
+		decryptPass, err := v.GetDecrpytionPassphrase()
+		if err != nil {
+			return fail(fmt.Errorf("error getting decryption passphrase: %s", err))
+		}
+		volume, err := handlers.NewVolume(v.Name, v.Remote.FileRoot, decryptPass, cfg.Server.Workers, fsAccessor, ftOpts)
+		if err != nil {
+			return fail(fmt.Errorf("Failed to init volume %s: %s", v.Name, err))
+		}
+		b.volumes = append(b.volumes, volume)
+		if v.Name == "" {
+			return volume.Handlers(), b, nil
+		}
+	}
+	return handlers.VolumesHandler(b.volumes), b, nil
+}
+
+// remoteProvider returns the provider for the remote of v, creating it if no
+// other volume shares it yet.
+func (b *backends) remoteProvider(v config.VolumeConfig, server config.ServerConfig, hostKeyCallback ssh.HostKeyCallback, logger *log.Logger) (*backend.Provider, error) {
+	remote := v.Remote
+	remote.FileRoot = ""
+	provider, found := b.providers[remote]
+	if !found {
+		remoteAuth, err := v.RemoteAuth()
+		if err != nil {
+			return nil, fmt.Errorf("error setting up authentication for the remote: %s", err)
+		}
+		clientConfig := RemoteClientConfig(v.Remote, remoteAuth, hostKeyCallback)
+		provider = backend.NewProvider(v.Remote.Addr, server.PoolOptions(), server.RetryPolicy(), clientConfig, logger)
+		b.providers[remote] = provider
+	}
+	return provider, nil
+}
+
+// RemoteClientConfig returns the config for connecting to the remote as
+// remote.User.
+func RemoteClientConfig(remote config.RemoteConfig, auth ssh.AuthMethod, hostKeyCallback ssh.HostKeyCallback) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User: remote.User,
+		Auth: []ssh.AuthMethod{
+			auth,
+		},
+		HostKeyCallback: hostKeyCallback,
+	}
+}
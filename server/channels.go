@@ -0,0 +1,74 @@
+package server
+
+import (
+	"io"
+	"log"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// handleChannels serves the channels of a connection, and returns once the
+// connection is closed and all of them are done.
+func handleChannels(chans <-chan ssh.NewChannel, reqHandlers sftp.Handlers, logger *log.Logger) {
+	var wg sync.WaitGroup
+	// Service the incoming Channel channel in go routine
+	for newChannel := range chans {
+		logger.Printf("Incoming channel: %s\n", newChannel.ChannelType())
+		wg.Add(1)
+		go func(newChannel ssh.NewChannel) {
+			defer wg.Done()
+			handleChannel(newChannel, reqHandlers, logger)
+		}(newChannel)
+	}
+	wg.Wait()
+}
+
+func handleChannel(newChannel ssh.NewChannel, reqHandlers sftp.Handlers, logger *log.Logger) {
+	// Channels have a type, depending on the application level
+	// protocol intended. In the case of an SFTP session, this is "subsystem"
+	// with a payload string of "<length=4>sftp"
+	if newChannel.ChannelType() != "session" {
+		_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		logger.Printf("Unknown channel type: %s\n", newChannel.ChannelType())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		logger.Println("could not accept channel:", err)
+		return
+	}
+	logger.Println("Channel accepted")
+
+	// Sessions have out-of-band requests such as "shell",
+	// "pty-req" and "env".  Here we handle only the
+	// "subsystem" request.
+	go func(in <-chan *ssh.Request) {
+		for req := range in {
+			logger.Printf("Request: %v\n", req.Type)
+			ok := false
+			switch req.Type {
+			case "subsystem":
+				var subsystem struct{ Name string }
+				if err := ssh.Unmarshal(req.Payload, &subsystem); err != nil {
+					logger.Println("invalid subsystem request:", err)
+					break
+				}
+				logger.Printf("Subsystem: %s\n", subsystem.Name)
+				ok = subsystem.Name == "sftp"
+			}
+			logger.Printf(" - accepted: %v\n", ok)
+			_ = req.Reply(ok, nil)
+		}
+	}(requests)
+
+	server := sftp.NewRequestServer(channel, reqHandlers)
+
+	if err := server.Serve(); err == io.EOF {
+		server.Close()
+		logger.Println("sftp client exited session.")
+	} else if err != nil {
+		logger.Println("sftp server completed with error:", err)
+	}
+}
@@ -0,0 +1,217 @@
+// Package server serves gocryptfs volumes over SFTP to the proxy users of a
+// config.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/flawedmatrix/gocryptsftp/config"
+	"github.com/flawedmatrix/gocryptsftp/handlers"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ErrServerClosed is returned by Serve once Shutdown is called.
+var ErrServerClosed = errors.New("server closed")
+
+// Server is an SSH server that serves the volumes of a config over SFTP.
+type Server struct {
+	sshConfig    *ssh.ServerConfig
+	userHandlers map[string]sftp.Handlers
+	backends     *backends
+	logger       *log.Logger
+
+	lock      sync.Mutex
+	closed    bool
+	listeners map[net.Listener]bool
+	active    sessions
+}
+
+// New opens the volumes of cfg, and sets up the authentication of its proxy
+// users. cfg must already be validated.
+func New(cfg *config.Config, logger *log.Logger) (*Server, error) {
+	// An SSH server is represented by a ServerConfig, which holds
+	// certificate details and handles authentication of ServerConns.
+	sshConfig, err := serverConfig(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := knownhosts.New(cfg.KnownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing known hosts file key: %s", err)
+	}
+
+	servedHandlers, b, err := volumeHandlers(cfg, hostKeyCallback, logger)
+	if err != nil {
+		return nil, err
+	}
+	userHandlers := map[string]sftp.Handlers{}
+	for _, u := range cfg.AllUsers() {
+		userHandlers[u.Name] = handlers.RestrictedHandler(servedHandlers, handlers.Access{
+			Root:     u.ServedRoot(),
+			ReadOnly: u.ReadOnly,
+		})
+	}
+
+	return &Server{
+		sshConfig:    sshConfig,
+		userHandlers: userHandlers,
+		backends:     b,
+		logger:       logger,
+
+		listeners: map[net.Listener]bool{},
+	}, nil
+}
+
+// serverConfig returns the config that authenticates the proxy users of cfg
+// and identifies the proxy with its host key.
+func serverConfig(cfg *config.Config, logger *log.Logger) (*ssh.ServerConfig, error) {
+	sshConfig := &ssh.ServerConfig{}
+	authorizedKeys := map[string]config.AuthorizedKeys{}
+	for _, u := range cfg.AllUsers() {
+		if u.PasswordHash != "" {
+			sshConfig.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+				logger.Println("Login:", c.User())
+				if err := cfg.CheckProxyPassword(c.User(), pass); err != nil {
+					return nil, fmt.Errorf("password rejected for %q", c.User())
+				}
+				return nil, nil
+			}
+		}
+		if u.AuthorizedKeysPath != "" {
+			keys, err := u.LoadAuthorizedKeys()
+			if err != nil {
+				return nil, fmt.Errorf("error loading authorized keys of %s: %s", u.Name, err)
+			}
+			authorizedKeys[u.Name] = keys
+		}
+	}
+	if len(authorizedKeys) > 0 {
+		sshConfig.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			logger.Println("Login:", c.User(), ssh.FingerprintSHA256(key))
+			u, err := cfg.FindUser(c.User())
+			if err != nil || !authorizedKeys[u.Name].Contains(key) {
+				return nil, fmt.Errorf("public key rejected for %q", c.User())
+			}
+			return nil, nil
+		}
+	}
+
+	hostKey, generated, err := cfg.LoadHostKey()
+	if err != nil {
+		return nil, fmt.Errorf("error loading host key: %s", err)
+	}
+	if generated {
+		logger.Printf("Generated new host key %s with fingerprint %s\n",
+			cfg.HostKeyPath, ssh.FingerprintSHA256(hostKey.PublicKey()))
+	}
+	sshConfig.AddHostKey(hostKey)
+	return sshConfig, nil
+}
+
+// Serve accepts connections on listener and serves them until Shutdown is
+// called, after which it returns ErrServerClosed. The listener is closed on
+// shutdown.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.track(listener) {
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	for {
+		nConn, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			s.logger.Println("failed to accept incoming connection", err)
+			continue
+		}
+		// Before use, a handshake must be performed on the incoming
+		// net.Conn.
+		sConn, chans, reqs, err := ssh.NewServerConn(nConn, s.sshConfig)
+		if err != nil {
+			s.logger.Println("failed to handshake", err)
+			continue
+		}
+		s.logger.Println("SSH server established")
+		if !s.addSession(sConn) {
+			_ = sConn.Close()
+			continue
+		}
+		reqHandlers := s.userHandlers[sConn.User()]
+
+		// The incoming Request channel must be serviced.
+		go ssh.DiscardRequests(reqs)
+
+		go func() {
+			handleChannels(chans, reqHandlers, s.logger)
+			s.active.remove(sConn)
+		}()
+	}
+}
+
+// track adds listener to the listeners closed on shutdown. It returns false
+// if the Server is already shut down.
+func (s *Server) track(listener net.Listener) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[listener] = true
+	return true
+}
+
+// addSession tracks the session of c. It returns false if the Server is
+// shutting down, in which case c must not be served.
+func (s *Server) addSession(c *ssh.ServerConn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.active.add(c)
+	return true
+}
+
+func (s *Server) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+// Shutdown stops accepting connections, and gives the active sessions up to
+// timeout to finish, closing them if they don't. It then closes the
+// connections to the remotes and wipes the keys of the volumes from memory.
+// The keys are only wiped once every session has ended, since sessions that
+// are still running may be using them.
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.lock.Lock()
+	s.closed = true
+	for listener := range s.listeners {
+		_ = listener.Close()
+	}
+	s.lock.Unlock()
+
+	ended := s.active.wait(timeout)
+	if !ended {
+		s.logger.Printf("%d sessions still active after %s, closing them\n", s.active.count(), timeout)
+		s.active.closeAll()
+		s.backends.closeRemotes()
+		ended = s.active.wait(sessionCloseTimeout)
+	}
+	s.backends.logStats()
+	s.backends.closeRemotes()
+	if !ended {
+		s.logger.Printf("%d sessions still active after being closed, leaving the keys in memory\n", s.active.count())
+		return
+	}
+	s.backends.closeVolumes()
+}
@@ -0,0 +1,269 @@
+package server_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flawedmatrix/gocryptsftp/backend/backendtest"
+	"github.com/flawedmatrix/gocryptsftp/config"
+	"github.com/flawedmatrix/gocryptsftp/filetree/filetreetest"
+	"github.com/flawedmatrix/gocryptsftp/server"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	proxyPassword  = "proxypass"
+	volumePassword = "test"
+)
+
+var _ = Describe("Server", func() {
+	var (
+		dir       string
+		volumeDir string
+		longName  string
+		bigFile   string
+		remote    *backendtest.Upstream
+		cfg       *config.Config
+		srv       *server.Server
+		listener  net.Listener
+		served    chan error
+		logs      *gbytes.Buffer
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "server-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		// Long enough for the encrypted name to exceed 255 bytes
+		longName = strings.Repeat("x", 200)
+		// Spans several blocks, with a partial last block
+		bigFile = strings.Repeat("0123456789", 30000)
+		volumeDir = filepath.Join(dir, "volume")
+		writeVolume(volumeDir, volumePassword, filetreetest.Tree{
+			"a.txt":                   "a",
+			"photos/2020/big.bin":     bigFile,
+			"photos/2020/" + longName: "long",
+		})
+
+		clientKey, clientKeyPEM, err := backendtest.NewKey()
+		Expect(err).NotTo(HaveOccurred())
+		remote, err = backendtest.StartUpstream(clientKey.PublicKey())
+		Expect(err).NotTo(HaveOccurred())
+
+		writeFile := func(name string, data []byte) string {
+			p := filepath.Join(dir, name)
+			Expect(ioutil.WriteFile(p, data, 0600)).To(Succeed())
+			return p
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(proxyPassword), bcrypt.MinCost)
+		Expect(err).NotTo(HaveOccurred())
+
+		cfg = &config.Config{
+			ProxyUser:         "proxy",
+			ProxyPasswordHash: string(hash),
+			KnownHostsPath:    writeFile("known_hosts", []byte(remote.KnownHostsLine()+"\n")),
+			HostKeyPath:       filepath.Join(dir, "host_key"),
+			Server:            config.DefaultServerConfig(),
+			Remote: config.RemoteConfig{
+				Addr:           remote.Addr(),
+				FileRoot:       volumeDir,
+				User:           "remote-user",
+				PrivateKeyPath: writeFile("id_ecdsa", clientKeyPEM),
+			},
+			Cache: config.DefaultCacheConfig(),
+		}
+		cfg.Server.Workers = 4
+		cfg.Passphrases.Decryption.File = writeFile("passphrase", []byte(volumePassword))
+	})
+
+	JustBeforeEach(func() {
+		Expect(cfg.Validate()).To(Succeed())
+
+		var err error
+		logs = gbytes.NewBuffer()
+		srv, err = server.New(cfg, log.New(io.MultiWriter(GinkgoWriter, logs), "", 0))
+		Expect(err).NotTo(HaveOccurred())
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		served = make(chan error, 1)
+		go func() {
+			served <- srv.Serve(listener)
+		}()
+	})
+
+	AfterEach(func() {
+		srv.Shutdown(time.Second)
+		Eventually(served).Should(Receive(Equal(server.ErrServerClosed)))
+		remote.Close()
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	dial := func(user, password string) (*ssh.Client, error) {
+		return ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.Password(password)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+
+	Context("with an SFTP client", func() {
+		var (
+			conn   *ssh.Client
+			client *sftp.Client
+		)
+
+		JustBeforeEach(func() {
+			var err error
+			conn, err = dial("proxy", proxyPassword)
+			Expect(err).NotTo(HaveOccurred())
+			client, err = sftp.NewClient(conn)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			client.Close()
+			conn.Close()
+		})
+
+		readFile := func(path string) string {
+			f, err := client.Open(path)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			defer f.Close()
+			data, err := ioutil.ReadAll(f)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			return string(data)
+		}
+
+		names := func(path string) []string {
+			infos, err := client.ReadDir(path)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			var names []string
+			for _, info := range infos {
+				names = append(names, info.Name())
+			}
+			return names
+		}
+
+		It("lists the decrypted directories", func() {
+			Expect(names("/")).To(ConsistOf("a.txt", "photos"))
+			Expect(names("/photos/2020")).To(ConsistOf("big.bin", longName))
+		})
+
+		It("stats the decrypted files", func() {
+			info, err := client.Stat("/photos/2020/big.bin")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Size()).To(BeEquivalentTo(len(bigFile)))
+			Expect(info.IsDir()).To(BeFalse())
+
+			info, err = client.Stat("/photos")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.IsDir()).To(BeTrue())
+
+			_, err = client.Stat("/missing")
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		})
+
+		It("reads the decrypted files", func() {
+			Expect(readFile("/a.txt")).To(Equal("a"))
+			Expect(readFile("/photos/2020/big.bin")).To(Equal(bigFile))
+			Expect(readFile("/photos/2020/" + longName)).To(Equal("long"))
+		})
+
+		It("encrypts the files it writes on the remote", func() {
+			f, err := client.Create("/photos/new.txt")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = f.Write([]byte("new"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			Expect(readFile("/photos/new.txt")).To(Equal("new"))
+			err = filepath.Walk(volumeDir, func(p string, info os.FileInfo, err error) error {
+				Expect(info.Name()).NotTo(Equal("new.txt"))
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects unknown channel types", func() {
+			_, _, err := conn.OpenChannel("direct-tcpip", nil)
+			var openErr *ssh.OpenChannelError
+			Expect(errors.As(err, &openErr)).To(BeTrue())
+			Expect(openErr.Reason).To(Equal(ssh.UnknownChannelType))
+		})
+
+		It("only accepts the sftp subsystem", func() {
+			session, err := conn.NewSession()
+			Expect(err).NotTo(HaveOccurred())
+			defer session.Close()
+			Expect(session.RequestSubsystem("shell")).NotTo(Succeed())
+			Expect(session.Shell()).NotTo(Succeed())
+		})
+
+		It("closes the sessions still active once the shutdown timeout passes", func() {
+			srv.Shutdown(10 * time.Millisecond)
+			_, err := client.Stat("/a.txt")
+			Expect(err).To(HaveOccurred())
+			Expect(logs).To(gbytes.Say("1 sessions still active after 10ms, closing them"))
+		})
+
+		Context("when volumes are configured", func() {
+			BeforeEach(func() {
+				cfg.Volumes = []config.VolumeConfig{{
+					Name:        "photos",
+					Remote:      cfg.Remote,
+					Passphrases: cfg.Passphrases,
+				}}
+				cfg.Remote = config.RemoteConfig{}
+				cfg.Passphrases = config.PassphrasesConfig{}
+			})
+
+			It("serves each volume under its name", func() {
+				Expect(names("/")).To(ConsistOf("photos"))
+				Expect(readFile("/photos/a.txt")).To(Equal("a"))
+			})
+
+			It("reports missing files as not existing", func() {
+				_, err := client.Stat("/photos/missing")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+				_, err = client.Open("/photos/missing")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+				_, err = client.Stat("/music")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		})
+	})
+
+	It("logs the fingerprint of the host key it generated", func() {
+		Expect(logs).To(gbytes.Say("Generated new host key .*host_key with fingerprint SHA256:"))
+	})
+
+	It("rejects wrong passwords", func() {
+		_, err := dial("proxy", "wrong")
+		Expect(err).To(MatchError(ContainSubstring("unable to authenticate")))
+	})
+
+	It("rejects unknown users", func() {
+		_, err := dial("someone-else", proxyPassword)
+		Expect(err).To(MatchError(ContainSubstring("unable to authenticate")))
+	})
+
+	It("stops accepting connections once shut down", func() {
+		srv.Shutdown(time.Second)
+		_, err := dial("proxy", proxyPassword)
+		Expect(err).To(HaveOccurred())
+		Expect(srv.Serve(listener)).To(Equal(server.ErrServerClosed))
+	})
+})
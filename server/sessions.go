@@ -0,0 +1,68 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sessionCloseTimeout is how long sessions are given to end after their
+// connections are closed on shutdown.
+const sessionCloseTimeout = 5 * time.Second
+
+// sessions tracks the connections of proxy clients, so that they can be
+// waited for or closed on shutdown.
+type sessions struct {
+	wg    sync.WaitGroup
+	lock  sync.Mutex
+	conns map[*ssh.ServerConn]bool
+}
+
+func (s *sessions) add(c *ssh.ServerConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conns == nil {
+		s.conns = map[*ssh.ServerConn]bool{}
+	}
+	s.conns[c] = true
+	s.wg.Add(1)
+}
+
+func (s *sessions) remove(c *ssh.ServerConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, c)
+	s.wg.Done()
+}
+
+func (s *sessions) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.conns)
+}
+
+// wait waits up to timeout for all sessions to end. It returns false if some
+// are still active.
+func (s *sessions) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// closeAll closes the connections of all active sessions.
+func (s *sessions) closeAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
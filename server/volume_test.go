@@ -0,0 +1,32 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flawedmatrix/gocryptsftp/filetree/filetreetest"
+	. "github.com/onsi/gomega"
+)
+
+// writeVolume generates a gocryptfs volume holding tree, encrypted with
+// password, in the directory dir on the local filesystem.
+func writeVolume(dir string, password string, tree filetreetest.Tree) {
+	const root = "/volume"
+	mfs := filetreetest.NewMemFS()
+	Expect(mfs.AddVolume(root, []byte(password), tree, filetreetest.VolumeOptions{})).To(Succeed())
+	Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+	for _, p := range mfs.Paths(root) {
+		localPath := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(p, root)))
+		info, err := mfs.Stat(p)
+		Expect(err).NotTo(HaveOccurred())
+		if info.IsDir() {
+			Expect(os.MkdirAll(localPath, 0755)).To(Succeed())
+			continue
+		}
+		data, err := mfs.ReadFile(p)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(localPath, data, 0644)).To(Succeed())
+	}
+}